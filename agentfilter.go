@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Agent forwarding modes
+const (
+	forwardAgentNo      = "no"
+	forwardAgentYes     = "yes"
+	forwardAgentConfirm = "confirm"
+)
+
+// forwardAgentTag is the instance tag that sets the agent forwarding mode for that instance
+const forwardAgentTag = "salio:forward-agent"
+
+var errAgentRestricted = errors.New("agent: operation not permitted on a forwarded agent")
+
+// agentForwarding decides whether and how the agent is forwarded to an instance. Forwarding is off unless Mode is
+// set, the instance is in one of the Clusters, or its salio:forward-agent tag enables it. If Keys is set only the
+// matching keys are exposed to the instance.
+type agentForwarding struct {
+	Mode     string
+	Clusters []string
+	Keys     []string
+}
+
+func validForwardAgentMode(mode string) error {
+	switch mode {
+	case "", forwardAgentNo, forwardAgentYes, forwardAgentConfirm:
+		return nil
+	}
+	return fmt.Errorf("invalid agent forwarding mode %q, expected %s, %s or %s", mode, forwardAgentNo, forwardAgentYes, forwardAgentConfirm)
+}
+
+// modeFor returns the forwarding mode for the instance
+func (f *agentForwarding) modeFor(i *instance) string {
+	if f.Mode != "" {
+		return f.Mode
+	}
+	if mode := i.Tags[forwardAgentTag]; mode != "" && validForwardAgentMode(mode) == nil {
+		return mode
+	}
+	for _, c := range f.Clusters {
+		if c == i.Cluster {
+			return forwardAgentYes
+		}
+	}
+	return forwardAgentNo
+}
+
+// agentFor returns the agent to forward to the instance, or nil if the agent should not be forwarded
+func (f *agentForwarding) agentFor(a agent.Agent, i *instance) (agent.Agent, error) {
+	if f == nil {
+		return nil, nil
+	}
+	mode := f.modeFor(i)
+	if mode == forwardAgentNo {
+		return nil, nil
+	}
+	if mode == forwardAgentYes && len(f.Keys) == 0 {
+		return a, nil
+	}
+
+	r := &restrictedAgent{Agent: a, confirm: mode == forwardAgentConfirm, host: fmt.Sprintf("%s (%s)", i.Name, i.ID)}
+	if len(f.Keys) > 0 {
+		signers, err := a.Signers()
+		if err != nil {
+			return nil, err
+		}
+		selected, err := selectSigners(a, signers, f.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("agent forwarding: %s", err)
+		}
+		for _, s := range selected {
+			r.allowed = append(r.allowed, s.PublicKey())
+		}
+	}
+	return r, nil
+}
+
+// restrictedAgent is the agent forwarded to an instance. It only lists and signs with the allowed keys, optionally
+// asks on the local terminal before signing, and refuses to change the local agent.
+type restrictedAgent struct {
+	agent.Agent
+	allowed []ssh.PublicKey
+	confirm bool
+	host    string
+}
+
+func (r *restrictedAgent) isAllowed(key ssh.PublicKey) bool {
+	if r.allowed == nil {
+		return true
+	}
+	for _, k := range r.allowed {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *restrictedAgent) List() ([]*agent.Key, error) {
+	keys, err := r.Agent.List()
+	if err != nil {
+		return nil, err
+	}
+	var allowed []*agent.Key
+	for _, k := range keys {
+		if r.isAllowed(k) {
+			allowed = append(allowed, k)
+		}
+	}
+	return allowed, nil
+}
+
+// permit checks that the key is forwarded and, in confirm mode, asks before it signs
+func (r *restrictedAgent) permit(key ssh.PublicKey) error {
+	if !r.isAllowed(key) {
+		return fmt.Errorf("agent: key %s is not forwarded", ssh.FingerprintSHA256(key))
+	}
+	if r.confirm {
+		yes, err := confirm(fmt.Sprintf("[?] %s wants to sign with %s %s, allow?", r.host, key.Type(), ssh.FingerprintSHA256(key)))
+		if err != nil {
+			return err
+		}
+		if !yes {
+			fmt.Printf("[!] refused signing request from %s\r\n", r.host)
+			return errors.New("agent: signing request refused")
+		}
+	}
+	return nil
+}
+
+func (r *restrictedAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	if err := r.permit(key); err != nil {
+		return nil, err
+	}
+	return r.Agent.Sign(key, data)
+}
+
+// SignWithFlags keeps the rsa-sha2-256 and rsa-sha2-512 flags of the request, without them RSA keys sign with SHA-1,
+// which servers reject
+func (r *restrictedAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if err := r.permit(key); err != nil {
+		return nil, err
+	}
+	if extended, ok := r.Agent.(agent.ExtendedAgent); ok {
+		return extended.SignWithFlags(key, data, flags)
+	}
+	return r.Agent.Sign(key, data)
+}
+
+func (r *restrictedAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+func (r *restrictedAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errAgentRestricted
+}
+
+func (r *restrictedAgent) Add(key agent.AddedKey) error {
+	return errAgentRestricted
+}
+
+func (r *restrictedAgent) Remove(key ssh.PublicKey) error {
+	return errAgentRestricted
+}
+
+func (r *restrictedAgent) RemoveAll() error {
+	return errAgentRestricted
+}
+
+func (r *restrictedAgent) Lock(passphrase []byte) error {
+	return errAgentRestricted
+}
+
+func (r *restrictedAgent) Unlock(passphrase []byte) error {
+	return errAgentRestricted
+}
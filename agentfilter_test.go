@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestAgentForwardingMode(t *testing.T) {
+	web := &instance{ID: "i-web", Cluster: "web", Tags: map[string]string{}}
+	db := &instance{ID: "i-db", Cluster: "db", Tags: map[string]string{forwardAgentTag: forwardAgentConfirm}}
+	other := &instance{ID: "i-other", Cluster: "other", Tags: map[string]string{}}
+
+	f := &agentForwarding{Clusters: []string{"web"}}
+	for _, tc := range []struct {
+		instance *instance
+		expected string
+	}{
+		{web, forwardAgentYes},
+		{db, forwardAgentConfirm},
+		{other, forwardAgentNo},
+	} {
+		if mode := f.modeFor(tc.instance); mode != tc.expected {
+			t.Errorf("Expected mode %s for %s, got %s", tc.expected, tc.instance.ID, mode)
+		}
+	}
+
+	f.Mode = forwardAgentNo
+	if mode := f.modeFor(web); mode != forwardAgentNo {
+		t.Errorf("Expected the flag to override the cluster, got %s", mode)
+	}
+}
+
+func TestRestrictedAgent(t *testing.T) {
+	keyring := agent.NewKeyring()
+	for _, comment := range []string{"github", "prod"} {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: comment}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &agentForwarding{Mode: forwardAgentYes, Keys: []string{"github"}}
+	forwarded, err := f.agentFor(keyring, &instance{ID: "i-web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := forwarded.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "github" {
+		t.Fatalf("Expected only the github key to be listed, got %d keys", len(keys))
+	}
+
+	all, _ := keyring.List()
+	for _, k := range all {
+		_, err := forwarded.Sign(k, []byte("data"))
+		if k.Comment == "github" && err != nil {
+			t.Errorf("Expected the github key to sign, got %s", err)
+		}
+		if k.Comment == "prod" && err == nil {
+			t.Errorf("Expected the prod key to be refused")
+		}
+	}
+	if err := forwarded.RemoveAll(); err == nil {
+		t.Errorf("Expected the forwarded agent to refuse changes")
+	}
+	if remaining, _ := keyring.List(); len(remaining) != 2 {
+		t.Errorf("Expected the local agent to be unchanged, got %d keys", len(remaining))
+	}
+
+	// signing through the forwarded agent keeps the SHA-2 flags of RSA keys
+	client, server := net.Pipe()
+	defer client.Close()
+	go agent.ServeAgent(forwarded, server)
+	remote := agent.NewClient(client)
+	forwardedKeys, err := remote.List()
+	if err != nil || len(forwardedKeys) != 1 {
+		t.Fatalf("Expected the github key through the forwarded agent, got %d keys %v", len(forwardedKeys), err)
+	}
+	signature, err := remote.SignWithFlags(forwardedKeys[0], []byte("data"), agent.SignatureFlagRsaSha256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature.Format != ssh.KeyAlgoRSASHA256 {
+		t.Errorf("Expected a %s signature, got %s", ssh.KeyAlgoRSASHA256, signature.Format)
+	}
+
+	f = &agentForwarding{}
+	if a, err := f.agentFor(keyring, &instance{ID: "i-web"}); a != nil || err != nil {
+		t.Errorf("Expected no forwarding by default")
+	}
+}
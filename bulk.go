@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// bulkTransfer copies files to or from many instances at once
+type bulkTransfer struct {
+	Recursive bool
+	Parallel  int
+
+	connect func(*instancePair) (*sshForwardingClient, error)
+}
+
+// bulkResult is the outcome of a transfer to or from a single instance
+type bulkResult struct {
+	Pair     *instancePair
+	Files    int
+	Duration time.Duration
+	Err      error
+}
+
+// Push uploads the local path to the remote path on every candidate and verifies the checksums of all copied files
+func (b *bulkTransfer) Push(candidates []*instancePair, localPath, remotePath string) []*bulkResult {
+	local, err := localChecksums(localPath)
+	if err != nil {
+		return b.failAll(candidates, err)
+	}
+
+	return b.each(candidates, func(pair *instancePair, client *sshForwardingClient) (int, error) {
+		// work out where the files end up before the upload creates the target
+		target := remotePath
+		if target == "" {
+			target = "."
+		}
+		isDir, err := remoteIsDir(client, target)
+		if err != nil {
+			return 0, err
+		}
+		if isDir {
+			target = path.Join(target, filepath.Base(localPath))
+		}
+
+		transfer, err := newFileTransfer(client, false)
+		if err != nil {
+			return 0, err
+		}
+		err = transfer.Upload(localPath, remotePath, b.Recursive)
+		transfer.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		remote, err := remoteChecksums(client, target)
+		if err != nil {
+			return 0, err
+		}
+		return compareChecksums(local, remote)
+	})
+}
+
+// Pull downloads the remote path from every candidate into a directory per instance below localDir and verifies the
+// checksums of all copied files. Only the bytes that were copied are compared, so that files that grow while they are
+// pulled, such as logs, can be verified.
+func (b *bulkTransfer) Pull(candidates []*instancePair, remotePath, localDir string) []*bulkResult {
+	name := path.Base(remotePath)
+	if remotePath == "" || name == "." || name == "/" {
+		return b.failAll(candidates, errors.New("the remote path must name a file or directory"))
+	}
+
+	return b.each(candidates, func(pair *instancePair, client *sshForwardingClient) (int, error) {
+		dir := filepath.Join(localDir, instanceDirName(pair.Instance))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return 0, err
+		}
+
+		transfer, err := newFileTransfer(client, false)
+		if err != nil {
+			return 0, err
+		}
+		err = transfer.Download(remotePath, dir, b.Recursive)
+		transfer.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		local := make(map[string]string)
+		sizes := make(map[string]int64)
+		err = walkFiles(filepath.Join(dir, name), "", func(rel, file string, info os.FileInfo) error {
+			var err error
+			sizes[rel] = info.Size()
+			local[rel], err = fileChecksum(file)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		remote, err := remotePrefixChecksums(client, remotePath, sizes)
+		if err != nil {
+			return 0, err
+		}
+		return compareChecksums(local, remote)
+	})
+}
+
+// each connects to every candidate, at most Parallel at a time, and runs fn with the connection
+func (b *bulkTransfer) each(candidates []*instancePair, fn func(*instancePair, *sshForwardingClient) (int, error)) []*bulkResult {
+	parallel := b.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	results := make([]*bulkResult, len(candidates))
+
+	var wg sync.WaitGroup
+	for i := range candidates {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			pair := candidates[i]
+			res := &bulkResult{Pair: pair}
+			start := time.Now()
+			client, err := b.connect(pair)
+			if err == nil {
+				res.Files, err = fn(pair, client)
+				client.Close()
+			}
+			res.Err = err
+			res.Duration = time.Since(start)
+			results[i] = res
+
+			if err != nil {
+				fmt.Printf("[!] %s (%s) failed: %s\n", pair.Instance.Name, pair.Instance.ID, err)
+			} else {
+				fmt.Printf("[+] %s (%s) done, %d file(s) verified\n", pair.Instance.Name, pair.Instance.ID, res.Files)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func (b *bulkTransfer) failAll(candidates []*instancePair, err error) []*bulkResult {
+	var results []*bulkResult
+	for _, c := range candidates {
+		results = append(results, &bulkResult{Pair: c, Err: err})
+	}
+	return results
+}
+
+// printBulkSummary prints one line per instance and returns an error if any of the transfers failed
+func printBulkSummary(w io.Writer, results []*bulkResult) error {
+	longestName := 0
+	for _, r := range results {
+		if len(r.Pair.Instance.Name) > longestName {
+			longestName = len(r.Pair.Instance.Name)
+		}
+	}
+
+	failed := 0
+	fmt.Fprintln(w)
+	for _, r := range results {
+		status := "ok"
+		if r.Err != nil {
+			status = "FAILED: " + r.Err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "%-19s %s %5d file(s) %8s  %s\n", r.Pair.Instance.ID, padToLen(r.Pair.Instance.Name, " ", longestName), r.Files, r.Duration.Round(time.Millisecond), status)
+	}
+	fmt.Fprintf(w, "\n[+] %d succeeded, %d failed\n", len(results)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d transfer(s) failed", failed)
+	}
+	return nil
+}
+
+// instanceDirName is the local directory name used for files pulled from an instance
+func instanceDirName(i *instance) string {
+	if i.Name == "" {
+		return i.ID
+	}
+	return strings.Replace(i.Name, string(filepath.Separator), "_", -1) + "_" + i.ID
+}
+
+// remoteIsDir reports whether the remote path is an existing directory
+func remoteIsDir(client *sshForwardingClient, p string) (bool, error) {
+	err := Exec(client, "test -d "+shellPath(p), ioutil.Discard, ioutil.Discard)
+	if _, ok := err.(*ssh.ExitError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// remoteChecksums returns the sha256 checksums of the remote file, or of all files below the remote directory keyed
+// by their slash separated path relative to it. A single file is keyed by the empty string.
+func remoteChecksums(client *sshForwardingClient, p string) (map[string]string, error) {
+	isDir, err := remoteIsDir(client, p)
+	if err != nil {
+		return nil, err
+	}
+	cmd := "sha256sum " + shellPath(p)
+	if isDir {
+		cmd = fmt.Sprintf("cd %s && find . -type f -exec sha256sum {} +", shellPath(p))
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := Exec(client, cmd, &stdout, &stderr); err != nil {
+		return nil, fmt.Errorf("checksum failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return parseChecksums(stdout.String(), isDir), nil
+}
+
+// remotePrefixChecksums returns the sha256 checksums of the first size bytes of each remote file, keyed like
+// remoteChecksums. The script is sent on stdin, as a command line for many files could be too long.
+func remotePrefixChecksums(client *sshForwardingClient, p string, sizes map[string]int64) (map[string]string, error) {
+	var names []string
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var script strings.Builder
+	for _, name := range names {
+		file := p
+		if name != "" {
+			file = strings.TrimSuffix(p, "/") + "/" + name
+		}
+		fmt.Fprintf(&script, "head -c %d < %s | sha256sum\n", sizes[name], shellPath(file))
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdin = strings.NewReader(script.String())
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run("sh -s"); err != nil {
+		return nil, fmt.Errorf("checksum failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != len(names) {
+		return nil, fmt.Errorf("checksum failed: expected %d checksums, got %d %s", len(names), len(lines), strings.TrimSpace(stderr.String()))
+	}
+	sums := make(map[string]string)
+	for n, name := range names {
+		sums[name] = strings.TrimSuffix(lines[n], "  -")
+	}
+	return sums, nil
+}
+
+// checksumUnescaper undoes the escaping of names with a backslash or a line break in sha256sum output
+var checksumUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r")
+
+// parseChecksums parses sha256sum output into checksums keyed like remoteChecksums. sha256sum marks lines with escaped
+// names with a leading backslash.
+func parseChecksums(output string, isDir bool) map[string]string {
+	sums := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		escaped := strings.HasPrefix(line, `\`)
+		if escaped {
+			line = line[1:]
+		}
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key := ""
+		if isDir {
+			key = fields[1]
+			if escaped {
+				key = checksumUnescaper.Replace(key)
+			}
+			key = strings.TrimPrefix(key, "./")
+		}
+		sums[key] = fields[0]
+	}
+	return sums
+}
+
+// localChecksums is the local equivalent of remoteChecksums
+func localChecksums(p string) (map[string]string, error) {
+	sums := make(map[string]string)
+	err := walkFiles(p, "", func(rel, file string, info os.FileInfo) error {
+		var err error
+		sums[rel], err = fileChecksum(file)
+		return err
+	})
+	return sums, err
+}
+
+// walkFiles calls fn for the local file, or every regular file below the local directory, with its slash separated
+// path relative to it. Symlinks are followed like uploads do.
+func walkFiles(p, rel string, fn func(rel, file string, info os.FileInfo) error) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return fn(rel, p, info)
+	}
+	entries, err := ioutil.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := walkFiles(filepath.Join(p, entry.Name()), path.Join(rel, entry.Name()), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// compareChecksums verifies that every file in the source has the same checksum in the copy and returns the number
+// of verified files
+func compareChecksums(source, copied map[string]string) (int, error) {
+	var mismatches []string
+	for name, sum := range source {
+		if copied[name] != sum {
+			if name == "" {
+				name = "file"
+			}
+			mismatches = append(mismatches, name)
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		if len(mismatches) > 5 {
+			mismatches = append(mismatches[:5], "...")
+		}
+		return 0, fmt.Errorf("checksum mismatch for %s", strings.Join(mismatches, ", "))
+	}
+	return len(source), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseChecksums(t *testing.T) {
+	output := "aaaa  ./app.conf\n" +
+		"bbbb  ./logs/today.log\n" +
+		"\\cccc  ./back\\\\slash\n" +
+		"\\dddd  ./line\\nbreak\n" +
+		"garbage\n"
+	expected := map[string]string{
+		"app.conf":       "aaaa",
+		"logs/today.log": "bbbb",
+		"back\\slash":    "cccc",
+		"line\nbreak":    "dddd",
+	}
+	if got := parseChecksums(output, true); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if got := parseChecksums("\\eeee  /tmp/new\\nline\n", false); !reflect.DeepEqual(got, map[string]string{"": "eeee"}) {
+		t.Errorf("Expected a single file to be keyed by the empty string, got %v", got)
+	}
+}
+
+func TestCompareChecksums(t *testing.T) {
+	source := map[string]string{"a": "1", "b": "2"}
+	tests := []struct {
+		copied   map[string]string
+		verified int
+		err      string
+	}{
+		{map[string]string{"a": "1", "b": "2", "extra": "3"}, 2, ""},
+		{map[string]string{"a": "1", "b": "3"}, 0, "checksum mismatch for b"},
+		{map[string]string{"a": "1"}, 0, "checksum mismatch for b"},
+		{map[string]string{}, 0, "checksum mismatch for a, b"},
+	}
+	for _, test := range tests {
+		verified, err := compareChecksums(source, test.copied)
+		if verified != test.verified || (err == nil) != (test.err == "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("Expected %d verified and error %q for %v, got %d %v", test.verified, test.err, test.copied, verified, err)
+		}
+	}
+
+	if _, err := compareChecksums(map[string]string{"": "1"}, map[string]string{"": "2"}); err == nil || err.Error() != "checksum mismatch for file" {
+		t.Errorf("Expected a mismatch of a single file, got %v", err)
+	}
+	many := map[string]string{"a": "1", "b": "1", "c": "1", "d": "1", "e": "1", "f": "1"}
+	if _, err := compareChecksums(many, nil); err == nil || err.Error() != "checksum mismatch for a, b, c, d, e, ..." {
+		t.Errorf("Expected the mismatches to be cut short, got %v", err)
+	}
+}
+
+func TestLocalChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"app.conf": "hello", "logs/today.log": ""}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// symlinks are followed like uploads do
+	if err := os.Symlink("app.conf", filepath.Join(dir, "linked.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("logs", filepath.Join(dir, "linked")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"app.conf":         "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"linked.conf":      "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"logs/today.log":   "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"linked/today.log": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}
+	if got, err := localChecksums(dir); err != nil || !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v %v", expected, got, err)
+	}
+	if got, err := localChecksums(filepath.Join(dir, "app.conf")); err != nil || !reflect.DeepEqual(got, map[string]string{"": expected["app.conf"]}) {
+		t.Errorf("Expected a single file to be keyed by the empty string, got %v %v", got, err)
+	}
+	if _, err := localChecksums(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected an error for a missing path")
+	}
+}
+
+func TestRemotePrefixChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "logs", "today's.log")
+	if err := ioutil.WriteFile(log, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	local, err := localChecksums(filepath.Join(dir, "logs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the log grows after it was copied
+	f, err := os.OpenFile(log, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(" world")
+	f.Close()
+
+	client := transferServer(t, func(ch ssh.Channel, typ, arg string) uint32 {
+		cmd := exec.Command("sh", "-c", arg)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = ch, ch, ch.Stderr()
+		if err := cmd.Run(); err != nil {
+			return 1
+		}
+		return 0
+	})
+	remote, err := remotePrefixChecksums(client, filepath.Join(dir, "logs"), map[string]int64{"today's.log": 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compareChecksums(local, remote); err != nil {
+		t.Errorf("Expected the copied bytes to match, got %s", err)
+	}
+}
+
+func TestInstanceDirName(t *testing.T) {
+	tests := []struct {
+		instance *instance
+		expected string
+	}{
+		{&instance{ID: "i-1", Name: "web.prod"}, "web.prod_i-1"},
+		{&instance{ID: "i-2"}, "i-2"},
+		{&instance{ID: "i-3", Name: "web" + string(filepath.Separator) + "prod"}, "web_prod_i-3"},
+	}
+	for _, test := range tests {
+		if got := instanceDirName(test.instance); got != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, got)
+		}
+	}
+}
+
+func TestPrintBulkSummary(t *testing.T) {
+	ok := &bulkResult{Pair: &instancePair{Instance: &instance{ID: "i-1", Name: "web.prod"}}, Files: 3}
+	failed := &bulkResult{Pair: &instancePair{Instance: &instance{ID: "i-2", Name: "db"}}, Err: errors.New("connection refused")}
+
+	var out bytes.Buffer
+	if err := printBulkSummary(&out, []*bulkResult{ok}); err != nil {
+		t.Errorf("Expected no error when all transfers succeed, got %s", err)
+	}
+	if !strings.Contains(out.String(), "1 succeeded, 0 failed") {
+		t.Errorf("Expected the totals, got %q", out.String())
+	}
+
+	out.Reset()
+	err := printBulkSummary(&out, []*bulkResult{ok, failed})
+	if err == nil || err.Error() != "1 transfer(s) failed" {
+		t.Errorf("Expected an error for the failed transfer, got %v", err)
+	}
+	for _, line := range []string{"i-1", "web.prod", "3 file(s)", "ok", "FAILED: connection refused", "1 succeeded, 1 failed"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected the summary to contain %q, got %q", line, out.String())
+		}
+	}
+}
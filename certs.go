@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// loadPublicKeys reads all keys from a file in authorized_keys format, e.g. the public key of a SSH CA
+func loadPublicKeys(file string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public keys found", file)
+	}
+	return keys, nil
+}
+
+// loadCertSigner reads a user certificate and pairs it with its private key, which is taken from the signers if one
+// of them matches or otherwise read from the file without the "-cert.pub" suffix
+func loadCertSigner(file string, signers []ssh.Signer) (ssh.Signer, error) {
+	keys, err := loadPublicKeys(file)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := keys[0].(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", file)
+	}
+
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), cert.Key.Marshal()) {
+			return ssh.NewCertSigner(cert, s)
+		}
+	}
+
+	keyFile := strings.TrimSuffix(file, "-cert.pub")
+	if keyFile == file {
+		return nil, fmt.Errorf("the private key for %s is not in the ssh-agent", file)
+	}
+	// loadPrivateKey asks for the passphrase of an encrypted key and remembers it for the other connections
+	key, err := loadPrivateKey(keyFile)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("the private key for %s is neither in the ssh-agent nor in %s", file, keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyFile, err)
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// userCertSigners loads the certificate files and returns them in front of the other signers, so that the
+// certificates are offered first
+func userCertSigners(files []string, signers []ssh.Signer) ([]ssh.Signer, error) {
+	var certs []ssh.Signer
+	for _, file := range files {
+		s, err := loadCertSigner(file, signers)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, s)
+	}
+	return append(certs, signers...), nil
+}
+
+// checkUserCert reports why a user certificate can't be used to log in as the user. Servers only reply with a
+// generic authentication failure, so this is checked before a certificate is offered.
+func checkUserCert(cert *ssh.Certificate, user string, now time.Time) error {
+	if cert.CertType != ssh.UserCert {
+		return errors.New("is not a user certificate")
+	}
+	if after := time.Unix(int64(cert.ValidAfter), 0); now.Before(after) {
+		return fmt.Errorf("is not valid before %s", after.Format(time.RFC3339))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		if before := time.Unix(int64(cert.ValidBefore), 0); !now.Before(before) {
+			return fmt.Errorf("expired at %s", before.Format(time.RFC3339))
+		}
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil
+	}
+	for _, p := range cert.ValidPrincipals {
+		if p == user {
+			return nil
+		}
+	}
+	return fmt.Errorf("is not valid for user %s, principals are %s", user, strings.Join(cert.ValidPrincipals, ", "))
+}
+
+// authSigners drops the certificates that can't be used to log in as the user and returns the reasons
+func authSigners(signers []ssh.Signer, user string) ([]ssh.Signer, []string) {
+	var usable []ssh.Signer
+	var problems []string
+	now := time.Now()
+	for _, s := range signers {
+		if cert, ok := s.PublicKey().(*ssh.Certificate); ok {
+			if err := checkUserCert(cert, user, now); err != nil {
+				problems = append(problems, fmt.Sprintf("certificate %q %s", cert.KeyId, err))
+				continue
+			}
+		}
+		usable = append(usable, s)
+	}
+	return usable, problems
+}
+
+// authError adds the reasons certificates were not offered to an authentication error
+func authError(err error, problems []string) error {
+	if err == nil || len(problems) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w, skipped %s", err, strings.Join(problems, ", "))
+}
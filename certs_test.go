@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testSigner(t *testing.T) ssh.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func testCert(t *testing.T, ca ssh.Signer, certType uint32, principals []string, validBefore time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             testHostKey(t),
+		KeyId:           "test",
+		CertType:        certType,
+		ValidPrincipals: principals,
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCheckUserCert(t *testing.T) {
+	ca := testSigner(t)
+	now := time.Now()
+
+	valid := testCert(t, ca, ssh.UserCert, []string{"admin", "ubuntu"}, now.Add(time.Hour))
+	if err := checkUserCert(valid, "admin", now); err != nil {
+		t.Errorf("Expected a valid certificate, got %s", err)
+	}
+	if err := checkUserCert(valid, "root", now); err == nil || !strings.Contains(err.Error(), "admin, ubuntu") {
+		t.Errorf("Expected a principals error, got %v", err)
+	}
+	expired := testCert(t, ca, ssh.UserCert, nil, now.Add(-time.Hour))
+	if err := checkUserCert(expired, "admin", now); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected an expiry error, got %v", err)
+	}
+}
+
+func TestHostCertificates(t *testing.T) {
+	ca := testSigner(t)
+	v, err := newHostKeyVerifier("/nonexistent/known_hosts", hostKeyStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Authorities = []ssh.PublicKey{ca.PublicKey()}
+	check := v.Callback("i-web")
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	now := time.Now()
+
+	if err := check("10.0.0.1:22", addr, testCert(t, ca, ssh.HostCert, []string{"10.0.0.1"}, now.Add(time.Hour))); err != nil {
+		t.Errorf("Expected a certificate signed by the CA to be trusted, got %s", err)
+	}
+	err = check("10.0.0.2:22", addr, testCert(t, ca, ssh.HostCert, []string{"10.0.0.1"}, now.Add(time.Hour)))
+	if err == nil || !strings.Contains(err.Error(), "principal") {
+		t.Errorf("Expected a principal error, got %v", err)
+	}
+	err = check("10.0.0.3:22", addr, testCert(t, ca, ssh.HostCert, []string{"10.0.0.3"}, now.Add(-time.Hour)))
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected an expiry error, got %v", err)
+	}
+	if err := check("10.0.0.4:22", addr, testCert(t, testSigner(t), ssh.HostCert, []string{"10.0.0.4"}, now.Add(time.Hour))); err == nil {
+		t.Errorf("Expected a certificate from another CA to fall back to known_hosts and be rejected")
+	}
+}
+
+func TestLoadCertSignerEncryptedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, testSigner(t), ssh.UserCert, []string{"ubuntu"}, time.Now().Add(time.Hour))
+	cert.Key = pub
+	if err := cert.SignCert(rand.Reader, testSigner(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the passphrase has already been asked for when the identities were loaded
+	loadedKeysMu.Lock()
+	loadedKeys[keyFile] = key
+	loadedKeysMu.Unlock()
+	defer func() {
+		loadedKeysMu.Lock()
+		delete(loadedKeys, keyFile)
+		loadedKeysMu.Unlock()
+	}()
+
+	signer, err := loadCertSigner(keyFile+"-cert.pub", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), cert.Marshal()) {
+		t.Errorf("Expected the certificate to be paired with the encrypted key")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// profileAliases are the friendlier names of flags that can be used in profiles, any other global flag can be set by
+// its own name
+var profileAliases = map[string]string{
+	"profile":         "p",
+	"region":          "r",
+	"user":            "instance-user",
+	"forwards":        "L",
+	"remote-forwards": "R",
+	"socks":           "D",
+}
+
+// Profile settings that are not flags
+const (
+	profileSearch      = "search"
+	profileDescription = "description"
+)
+
+// defaultConfigPath is the salio config file, ~/.config/salio/config.yaml on Linux
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "config.yaml"
+	}
+	return filepath.Join(dir, "salio", "config.yaml")
+}
+
+// salioConfig is the config file, which holds named profiles of settings:
+//
+//	profiles:
+//	  pg-prod:
+//	    description: production database
+//	    profile: prod
+//	    region: ap-southeast-2
+//	    search: db prod
+//	    user: admin
+//	    forwards:
+//	      - ${PG_PORT:-5432}:db.internal:5432
+type salioConfig struct {
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+func loadConfig(file string) (*salioConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c := &salioConfig{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return c, nil
+}
+
+// Profile returns the settings of the named profile
+func (c *salioConfig) Profile(name string) (map[string]interface{}, error) {
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile %q, the profiles are: %s", name, strings.Join(c.Names(), ", "))
+	}
+	return p, nil
+}
+
+// Names returns the profile names in order
+func (c *salioConfig) Names() []string {
+	var names []string
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile sets the flags from the profile that were not given on the command line, and returns the search
+// terms of the profile. Environment variables in values are expanded.
+func applyProfile(flags *flag.FlagSet, name string, profile map[string]interface{}) ([]string, error) {
+	visited := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { visited[f.Name] = true })
+
+	var keys []string
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var search []string
+	for _, key := range keys {
+		if key == profileDescription {
+			continue
+		}
+		var f *flag.Flag
+		if key != profileSearch {
+			flagName := key
+			if alias, ok := profileAliases[key]; ok {
+				flagName = alias
+			}
+			if f = flags.Lookup(flagName); f == nil {
+				return nil, fmt.Errorf("profile %s: unknown setting %q", name, key)
+			}
+			// flags on the command line override the profile
+			if visited[f.Name] {
+				continue
+			}
+		}
+
+		values, err := profileValues(profile[key])
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %s %s", name, key, err)
+		}
+		for n, v := range values {
+			if values[n], err = expandEnv(v); err != nil {
+				return nil, fmt.Errorf("profile %s: %s: %s", name, key, err)
+			}
+		}
+		if f == nil {
+			for _, v := range values {
+				search = append(search, strings.Fields(v)...)
+			}
+			continue
+		}
+		for _, v := range values {
+			if err := flags.Set(f.Name, v); err != nil {
+				return nil, fmt.Errorf("profile %s: %s: %s", name, key, err)
+			}
+		}
+	}
+	return search, nil
+}
+
+func profileValues(value interface{}) ([]string, error) {
+	if v, ok := profileValue(value); ok {
+		return []string{v}, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("must be a value or a list of values")
+	}
+	var values []string
+	for _, item := range list {
+		v, ok := profileValue(item)
+		if !ok {
+			return nil, errors.New("must be a list of values")
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// profileValue formats a YAML scalar, e.g. a port number or true, as the string given to the flag
+func profileValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case int, int64, uint64, float64, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// expandEnv replaces $VAR and ${VAR} with the value of the environment variable, and ${VAR:-default} with the default
+// if it is unset or empty. It is an error to use an unset variable without a default.
+func expandEnv(s string) (string, error) {
+	var missing []string
+	expanded := os.Expand(s, func(name string) string {
+		if n := strings.Index(name, ":-"); n >= 0 {
+			if v := os.Getenv(name[:n]); v != "" {
+				return v
+			}
+			return name[n+2:]
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// printProfiles lists the profiles with their descriptions
+func printProfiles(w io.Writer, c *salioConfig) {
+	names := c.Names()
+	if len(names) == 0 {
+		fmt.Fprintln(w, "[+] no profiles")
+		return
+	}
+	longestName := 0
+	for _, name := range names {
+		if len(name) > longestName {
+			longestName = len(name)
+		}
+	}
+	for _, name := range names {
+		description, _ := c.Profiles[name][profileDescription].(string)
+		fmt.Fprintf(w, "@%s  %s\n", padToLen(name, " ", longestName), description)
+	}
+}
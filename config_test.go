@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+
+	doc := `
+# salio profiles
+profiles:
+  pg-prod:
+    description: "production database" # the main one
+    search: db prod
+    N: true
+    port: 5432
+    forwards:
+    - 5432:db.internal:5432
+    - '6543:db.internal:5432'
+    proxy-allow: [10.0.0.0/16, "*.internal"]
+  empty:
+`
+	if err := ioutil.WriteFile(file, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := c.Names(); !reflect.DeepEqual(names, []string{"empty", "pg-prod"}) {
+		t.Errorf("Expected the profiles empty and pg-prod, got %v", names)
+	}
+	p, err := c.Profile("pg-prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"description": {"production database"},
+		"search":      {"db prod"},
+		"N":           {"true"},
+		"port":        {"5432"},
+		"forwards":    {"5432:db.internal:5432", "6543:db.internal:5432"},
+		"proxy-allow": {"10.0.0.0/16", "*.internal"},
+	}
+	for key, values := range expected {
+		if got, err := profileValues(p[key]); err != nil || !reflect.DeepEqual(got, values) {
+			t.Errorf("Expected %s to be %v, got %v %v", key, values, got, err)
+		}
+	}
+
+	for _, invalid := range []string{
+		"profiles:\n  a: 1\n    b: 2\n",
+		"profiles:\n\ta: 1\n",
+		"profiles:\n  a: {}\n  a: {}\n",
+		"a: \"unterminated\n",
+		"colour: blue\n",
+		"- a\n",
+	} {
+		if err := ioutil.WriteFile(file, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(file); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	os.Setenv("SALIO_TEST_PORT", "15432")
+	defer os.Unsetenv("SALIO_TEST_PORT")
+
+	flags := flag.NewFlagSet("salio", flag.ContinueOnError)
+	region := flags.String("r", "", "")
+	user := flags.String("instance-user", "", "")
+	noShell := flags.Bool("N", false, "")
+	var forwards stringList
+	flags.Var(&forwards, "L", "")
+	if err := flags.Parse([]string{"-instance-user", "root"}); err != nil {
+		t.Fatal(err)
+	}
+
+	profile := map[string]interface{}{
+		"description": "production database",
+		"region":      "us-east-1",
+		"user":        "admin",
+		"N":           "true",
+		"search":      "db prod",
+		"forwards":    []interface{}{"${SALIO_TEST_PORT}:db:5432", "${SALIO_TEST_UNSET:-6543}:db:5432"},
+	}
+	search, err := applyProfile(flags, "pg-prod", profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(search, []string{"db", "prod"}) {
+		t.Errorf("Expected the search terms db prod, got %v", search)
+	}
+	if *region != "us-east-1" || !*noShell {
+		t.Errorf("Expected the profile to set the region and -N, got %q %v", *region, *noShell)
+	}
+	if *user != "root" {
+		t.Errorf("Expected the command line user to override the profile, got %q", *user)
+	}
+	if !reflect.DeepEqual([]string(forwards), []string{"15432:db:5432", "6543:db:5432"}) {
+		t.Errorf("Expected the forwards with expanded variables, got %v", forwards)
+	}
+
+	if _, err := applyProfile(flags, "bad", map[string]interface{}{"colour": "blue"}); err == nil {
+		t.Errorf("Expected an error for an unknown setting")
+	}
+	if _, err := applyProfile(flags, "overridden", map[string]interface{}{"user": "${SALIO_TEST_UNSET}"}); err != nil {
+		t.Errorf("Expected no error for a setting overridden on the command line, got %s", err)
+	}
+	if _, err := applyProfile(flags, "bad", map[string]interface{}{"search": "${SALIO_TEST_UNSET}"}); err == nil {
+		t.Errorf("Expected an error for an unset environment variable")
+	}
+}
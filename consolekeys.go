@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	consoleHostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	consoleHostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// errNoConsoleHostKeys is returned when the console output of an instance does not contain its host keys, e.g.
+// because cloud-init hasn't printed them yet or the AMI doesn't print them at all
+var errNoConsoleHostKeys = errors.New("no host keys in the console output")
+
+// defaultConsoleKeysDir is where host keys read from console output are cached
+func defaultConsoleKeysDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "salio", "host_keys")
+}
+
+// consoleHostKeys trusts the host keys that cloud-init prints to the boot console of an instance. Since the console
+// output can only be read through the EC2 API it is as trustworthy as the AWS credentials, which spares the trust on
+// first use prompt for every new instance in an auto scaling group. Keys are cached per instance ID, in memory and in
+// Dir if it is set.
+type consoleHostKeys struct {
+	Dir string
+
+	fetch func(instanceID string) (string, error)
+	mu    sync.Mutex
+	keys  map[string][]ssh.PublicKey
+}
+
+func newConsoleHostKeys(config *aws.Config, dir string) *consoleHostKeys {
+	svc := ec2.New(session.Must(session.NewSession(config)), &aws.Config{})
+	return &consoleHostKeys{
+		Dir: dir,
+		fetch: func(instanceID string) (string, error) {
+			resp, err := svc.GetConsoleOutput(&ec2.GetConsoleOutputInput{InstanceId: aws.String(instanceID)})
+			if err != nil {
+				return "", err
+			}
+			if resp.Output == nil {
+				return "", nil
+			}
+			output, err := base64.StdEncoding.DecodeString(*resp.Output)
+			return string(output), err
+		},
+		keys: make(map[string][]ssh.PublicKey),
+	}
+}
+
+// Verify checks the key presented by the instance against the keys from its console output. It reports whether the
+// key could be verified, if the console output holds no keys the caller has to fall back to another trust source. A
+// key that differs from the ones in the console output is an error.
+func (c *consoleHostKeys) Verify(instanceID string, key ssh.PublicKey) (bool, error) {
+	c.mu.Lock()
+	keys, ok := c.keys[instanceID]
+	if !ok {
+		keys = c.readCache(instanceID)
+		c.keys[instanceID] = keys
+	}
+	c.mu.Unlock()
+
+	if keys == nil || !containsKey(keys, key) {
+		// the cache may be from before the keys changed, the console is the source of truth. The lock isn't held
+		// while fetching, so the console output may be fetched twice by concurrent connections.
+		output, err := c.fetch(instanceID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[!] can't read the console output of %s: %s\n", instanceID, err)
+			return false, nil
+		}
+		keys, err = parseConsoleHostKeys(output)
+		if err == errNoConsoleHostKeys {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		c.mu.Lock()
+		c.keys[instanceID] = keys
+		c.writeCache(instanceID, keys)
+		c.mu.Unlock()
+	}
+
+	if !containsKey(keys, key) {
+		var fingerprints []string
+		for _, k := range keys {
+			fingerprints = append(fingerprints, k.Type()+" "+ssh.FingerprintSHA256(k))
+		}
+		return false, fmt.Errorf("host key %s %s of %s does not match the keys in its console output: %s", key.Type(), ssh.FingerprintSHA256(key), instanceID, strings.Join(fingerprints, ", "))
+	}
+	return true, nil
+}
+
+func (c *consoleHostKeys) cacheFile(instanceID string) string {
+	if c.Dir == "" || strings.ContainsAny(instanceID, `/\`) {
+		return ""
+	}
+	return filepath.Join(c.Dir, instanceID)
+}
+
+func (c *consoleHostKeys) readCache(instanceID string) []ssh.PublicKey {
+	file := c.cacheFile(instanceID)
+	if file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var keys []ssh.PublicKey
+	for len(data) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys
+}
+
+func (c *consoleHostKeys) writeCache(instanceID string, keys []ssh.PublicKey) {
+	file := c.cacheFile(instanceID)
+	if file == "" {
+		return
+	}
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.Write(ssh.MarshalAuthorizedKey(k))
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "[!] can't cache host keys: %s\n", err)
+		return
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "[!] can't cache host keys: %s\n", err)
+	}
+}
+
+// parseConsoleHostKeys returns the keys in the last host key block of the console output. The instance may have been
+// rebooted, in which case the last block is the current one.
+func parseConsoleHostKeys(output string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	var block []ssh.PublicKey
+	inBlock := false
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimSuffix(scanner.Text(), "\r"))
+		switch {
+		case strings.HasSuffix(line, consoleHostKeysBegin):
+			inBlock = true
+			block = nil
+		case strings.HasSuffix(line, consoleHostKeysEnd):
+			if inBlock && len(block) > 0 {
+				keys = block
+			}
+			inBlock = false
+		case inBlock:
+			// console lines can be prefixed with a timestamp, so parse from the first field that is a key type
+			fields := strings.Fields(line)
+			for n := range fields {
+				key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[n:], " ")))
+				if err == nil {
+					block = append(block, key)
+					break
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errNoConsoleHostKeys
+	}
+	return keys, nil
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
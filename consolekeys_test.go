@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConsoleHostKeys(t *testing.T) {
+	old := testHostKey(t)
+	current := testHostKey(t)
+	other := testHostKey(t)
+	block := func(key ssh.PublicKey) string {
+		return "[   12.345678] cloud-init[1234]: " + consoleHostKeysBegin + "\n" +
+			"[   12.345679] cloud-init[1234]: " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " root@ip-10-0-0-1\n" +
+			"[   12.345680] cloud-init[1234]: " + consoleHostKeysEnd + "\n"
+	}
+	output := "Booting\n" + block(old) + "rebooting\n" + block(current) + "login:\n"
+
+	keys, err := parseConsoleHostKeys(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !containsKey(keys, current) {
+		t.Errorf("Expected the key from the last block, got %d key(s)", len(keys))
+	}
+	if _, err := parseConsoleHostKeys("Booting\nlogin:\n"); err != errNoConsoleHostKeys {
+		t.Errorf("Expected errNoConsoleHostKeys, got %v", err)
+	}
+
+	fetches := 0
+	var c *consoleHostKeys
+	c = &consoleHostKeys{
+		fetch: func(instanceID string) (string, error) {
+			fetches++
+			if instanceID == "i-unreachable" {
+				return "", errors.New("access denied")
+			}
+			if instanceID == "i-slow" {
+				// other connections verify while the console output is fetched
+				c.Verify("i-web", current)
+			}
+			return output, nil
+		},
+		keys: make(map[string][]ssh.PublicKey),
+	}
+	for n := 0; n < 2; n++ {
+		if trusted, err := c.Verify("i-web", current); !trusted || err != nil {
+			t.Errorf("Expected the console key to be trusted, got %v %v", trusted, err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Expected verified keys to be cached, got %d fetches", fetches)
+	}
+	if _, err := c.Verify("i-web", other); err == nil {
+		t.Errorf("Expected a key that is not in the console output to be rejected")
+	}
+	if trusted, err := c.Verify("i-unreachable", current); trusted || err != nil {
+		t.Errorf("Expected a fallback when the console output can't be read, got %v %v", trusted, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.Verify("i-slow", current)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the console output to be fetched without holding the lock")
+	}
+}
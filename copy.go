@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// fileTransfer copies files and directories between this machine and an instance. Copies keep the permissions and
+// modification times of the source. If the destination is an existing directory the source is copied into it.
+type fileTransfer interface {
+	Upload(localPath, remotePath string, recursive bool) error
+	Download(remotePath, localPath string, recursive bool) error
+	Close() error
+}
+
+// newFileTransfer uses SFTP if the instance supports the subsystem and falls back to scp over exec otherwise
+func newFileTransfer(client *sshForwardingClient, progress bool) (fileTransfer, error) {
+	s, err := sftp.NewClient(client.Client)
+	if err == nil {
+		return &sftpTransfer{client: s, progress: progress}, nil
+	}
+	fmt.Printf("[+] sftp not available (%s), falling back to scp\n", err)
+	return &scpTransfer{client: client, progress: progress}, nil
+}
+
+// splitRemotePath splits a scp style target:path. Arguments without a colon before the first slash, and Windows
+// drive letters, are local paths.
+func splitRemotePath(arg string) (target, p string, remote bool) {
+	if filepath.VolumeName(arg) != "" {
+		return "", arg, false
+	}
+	i := strings.Index(arg, ":")
+	if i < 1 || strings.Contains(arg[:i], "/") {
+		return "", arg, false
+	}
+	return arg[:i], arg[i+1:], true
+}
+
+type sftpTransfer struct {
+	client   *sftp.Client
+	progress bool
+}
+
+func (t *sftpTransfer) Close() error {
+	return t.client.Close()
+}
+
+func (t *sftpTransfer) Upload(localPath, remotePath string, recursive bool) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if remotePath == "" {
+		remotePath = "."
+	}
+	target := remotePath
+	if info, err := t.client.Stat(remotePath); err == nil && info.IsDir() {
+		target = path.Join(remotePath, filepath.Base(localPath))
+	}
+	return t.upload(localPath, target, info, recursive)
+}
+
+func (t *sftpTransfer) upload(localPath, remotePath string, info os.FileInfo, recursive bool) error {
+	if info.IsDir() {
+		if !recursive {
+			return fmt.Errorf("%s is a directory, use -r to copy directories", localPath)
+		}
+		if _, err := t.client.Stat(remotePath); os.IsNotExist(err) {
+			if err := t.client.Mkdir(remotePath); err != nil {
+				return fmt.Errorf("%s: %s", remotePath, err)
+			}
+			if err := t.client.Chmod(remotePath, info.Mode().Perm()|0700); err != nil {
+				return fmt.Errorf("%s: %s", remotePath, err)
+			}
+		}
+		entries, err := ioutil.ReadDir(localPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			child := filepath.Join(localPath, entry.Name())
+			// follow symlinks like scp does
+			childInfo, err := os.Stat(child)
+			if err != nil {
+				return err
+			}
+			if err := t.upload(child, path.Join(remotePath, entry.Name()), childInfo, recursive); err != nil {
+				return err
+			}
+		}
+		return t.chmtime(remotePath, info)
+	}
+
+	if !info.Mode().IsRegular() {
+		fmt.Printf("[!] skipping %s, not a regular file\n", localPath)
+		return nil
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	remote, err := t.client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("%s: %s", remotePath, err)
+	}
+	// restrict the permissions before any data is written
+	if err := remote.Chmod(info.Mode().Perm()); err != nil {
+		remote.Close()
+		return fmt.Errorf("%s: %s", remotePath, err)
+	}
+	bar := newProgressBar(remotePath, info.Size(), t.progress)
+	if _, err := io.Copy(remote, io.TeeReader(f, bar)); err != nil {
+		remote.Close()
+		return fmt.Errorf("%s: %s", remotePath, err)
+	}
+	if err := remote.Close(); err != nil {
+		return fmt.Errorf("%s: %s", remotePath, err)
+	}
+	bar.Finish()
+	return t.chmtime(remotePath, info)
+}
+
+// chmtime sets the permissions and modification time of the remote path to those of the local file
+func (t *sftpTransfer) chmtime(remotePath string, info os.FileInfo) error {
+	if err := t.client.Chmod(remotePath, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("%s: %s", remotePath, err)
+	}
+	if err := t.client.Chtimes(remotePath, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("%s: %s", remotePath, err)
+	}
+	return nil
+}
+
+func (t *sftpTransfer) Download(remotePath, localPath string, recursive bool) error {
+	if remotePath == "" {
+		remotePath = "."
+	}
+	info, err := t.client.Stat(remotePath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", remotePath, err)
+	}
+	target := localPath
+	if local, err := os.Stat(localPath); err == nil && local.IsDir() {
+		name := path.Base(remotePath)
+		if name == "." || name == "/" {
+			if name, err = t.client.RealPath(remotePath); err != nil {
+				return err
+			}
+			name = path.Base(name)
+		}
+		target = filepath.Join(localPath, name)
+	}
+	return t.download(remotePath, target, info, recursive)
+}
+
+func (t *sftpTransfer) download(remotePath, localPath string, info os.FileInfo, recursive bool) error {
+	if info.IsDir() {
+		if !recursive {
+			return fmt.Errorf("%s is a directory, use -r to copy directories", remotePath)
+		}
+		if err := os.Mkdir(localPath, info.Mode().Perm()|0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		entries, err := t.client.ReadDir(remotePath)
+		if err != nil {
+			return fmt.Errorf("%s: %s", remotePath, err)
+		}
+		for _, entry := range entries {
+			child := path.Join(remotePath, entry.Name())
+			// follow symlinks like scp does
+			if entry.Mode()&os.ModeSymlink != 0 {
+				if entry, err = t.client.Stat(child); err != nil {
+					return fmt.Errorf("%s: %s", child, err)
+				}
+			}
+			if err := t.download(child, filepath.Join(localPath, path.Base(child)), entry, recursive); err != nil {
+				return err
+			}
+		}
+		return chmtime(localPath, info.Mode().Perm(), info.ModTime())
+	}
+
+	if !info.Mode().IsRegular() {
+		fmt.Printf("[!] skipping %s, not a regular file\n", remotePath)
+		return nil
+	}
+
+	remote, err := t.client.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", remotePath, err)
+	}
+	defer remote.Close()
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm()|0200)
+	if err != nil {
+		return err
+	}
+	bar := newProgressBar(localPath, info.Size(), t.progress)
+	n, err := io.Copy(io.MultiWriter(f, bar), remote)
+	if err == nil && n < info.Size() {
+		// the file was truncated while it was copied
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %s", remotePath, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	bar.Finish()
+	return chmtime(localPath, info.Mode().Perm(), info.ModTime())
+}
+
+// chmtime sets the permissions and modification time of a local path
+func chmtime(p string, mode os.FileMode, mtime time.Time) error {
+	if err := os.Chmod(p, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(p, mtime, mtime)
+}
+
+// progressBar draws the progress of a single file transfer on one terminal line
+type progressBar struct {
+	name    string
+	total   int64
+	current int64
+	enabled bool
+	drawn   time.Time
+}
+
+func newProgressBar(name string, total int64, enabled bool) *progressBar {
+	return &progressBar{name: name, total: total, enabled: enabled}
+}
+
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// Add records n more transferred bytes and redraws the bar at most ten times a second
+func (p *progressBar) Add(n int64) {
+	p.current += n
+	if p.enabled && time.Since(p.drawn) > 100*time.Millisecond {
+		p.draw()
+	}
+}
+
+// Finish draws the final state of the bar and moves to the next line
+func (p *progressBar) Finish() {
+	if !p.enabled {
+		return
+	}
+	p.draw()
+	fmt.Println()
+}
+
+func (p *progressBar) draw() {
+	p.drawn = time.Now()
+	percent := 100
+	if p.total > 0 {
+		percent = int(p.current * 100 / p.total)
+	}
+	const width = 30
+	filled := percent * width / 100
+	name := p.name
+	if len(name) > 30 {
+		name = "..." + name[len(name)-27:]
+	}
+	fmt.Printf("\r%-30s [%s%s] %3d%% %9s/%-9s", name, strings.Repeat("=", filled), strings.Repeat(" ", width-filled), percent, humanBytes(p.current), humanBytes(p.total))
+}
+
+// humanBytes formats a byte count with a binary unit suffix
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
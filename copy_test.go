@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSplitRemotePath(t *testing.T) {
+	tests := []struct {
+		arg    string
+		target string
+		path   string
+		remote bool
+	}{
+		{"cluster.stack.env:/tmp/file", "cluster.stack.env", "/tmp/file", true},
+		{"web:", "web", "", true},
+		{"./local/file", "", "./local/file", false},
+		{"dir/with:colon", "", "dir/with:colon", false},
+		{":file", "", ":file", false},
+	}
+
+	for _, test := range tests {
+		target, path, remote := splitRemotePath(test.arg)
+		if target != test.target || path != test.path || remote != test.remote {
+			t.Errorf("Expected %q to split into (%q, %q, %t), got (%q, %q, %t)", test.arg, test.target, test.path, test.remote, target, path, remote)
+		}
+	}
+}
+
+// transferServer is a SSH server that hands exec and subsystem requests to serve, which returns the exit status
+func transferServer(t *testing.T, serve func(ch ssh.Channel, typ, arg string) uint32) *sshForwardingClient {
+	l, _ := testSSHServer(t, nil, func(_ *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		for newChannel := range chans {
+			ch, reqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				for req := range reqs {
+					if req.Type != "exec" && req.Type != "subsystem" {
+						req.Reply(false, nil)
+						continue
+					}
+					var msg struct{ Arg string }
+					ssh.Unmarshal(req.Payload, &msg)
+					req.Reply(true, nil)
+					status := serve(ch, req.Type, msg.Arg)
+					ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+					ch.Close()
+				}
+			}()
+		}
+	})
+	return &sshForwardingClient{false, testSSHClient(t, l), false}
+}
+
+// scpSource plays a remote scp -f that waits for an ack before each message and after the last one, unless it
+// crashes after sending them
+func scpSource(crash bool, messages ...string) func(ch ssh.Channel, typ, arg string) uint32 {
+	return func(ch ssh.Channel, typ, arg string) uint32 {
+		ack := make([]byte, 1)
+		for _, m := range messages {
+			if _, err := io.ReadFull(ch, ack); err != nil {
+				return 1
+			}
+			ch.Write([]byte(m))
+		}
+		if crash {
+			return 1
+		}
+		if _, err := io.ReadFull(ch, ack); err != nil {
+			return 1
+		}
+		return 0
+	}
+}
+
+func TestSCPDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		messages []string
+		crash    bool
+		err      string
+	}{
+		{"file", []string{"T1500000000 0 1500000000 0\n", "C0640 5 file\n", "hello\x00"}, false, ""},
+		{"short", []string{"C0640 10 file\n", "hello"}, true, "EOF"},
+		{"missing", []string{"\x01scp: /nope: No such file or directory\n"}, false, "No such file or directory"},
+		{"empty", []string{"\n"}, false, "unexpected empty message"},
+	}
+	for _, test := range tests {
+		scp := &scpTransfer{client: transferServer(t, scpSource(test.crash, test.messages...))}
+		target := filepath.Join(dir, test.name)
+		err := scp.Download("file", target, false)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: Expected an error containing %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		data, err := ioutil.ReadFile(target)
+		if err != nil || string(data) != "hello" {
+			t.Errorf("%s: Expected the file to contain hello, got %q %v", test.name, data, err)
+		}
+		if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0640 || info.ModTime().Unix() != 1500000000 {
+			t.Errorf("%s: Expected the mode and time of the source, got %+v %v", test.name, info, err)
+		}
+	}
+}
+
+func TestSCPUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(local, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := make(chan string, 1)
+	received := make(chan string, 1)
+	client := transferServer(t, func(ch ssh.Channel, typ, cmd string) uint32 {
+		commands <- cmd
+		r := bufio.NewReader(ch)
+		ch.Write([]byte{0})
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return 0
+			}
+			if strings.HasPrefix(line, "C") {
+				var mode, size int
+				var name string
+				fmt.Sscanf(line, "C%o %d %s", &mode, &size, &name)
+				ch.Write([]byte{0})
+				data := make([]byte, size+1)
+				if _, err := io.ReadFull(r, data); err != nil {
+					return 1
+				}
+				received <- fmt.Sprintf("%04o %s %s", mode, name, data[:size])
+			}
+			ch.Write([]byte{0})
+		}
+	})
+
+	scp := &scpTransfer{client: client}
+	if err := scp.Upload(local, "~/uploads", false); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := <-commands; cmd != "scp -t -p -- ~/'uploads'" {
+		t.Errorf("Expected the home directory to be left unquoted, got %q", cmd)
+	}
+	if got := <-received; got != "0600 file hello" {
+		t.Errorf("Expected the file to be sent, got %q", got)
+	}
+}
+
+// sftpServer serves the sftp subsystem from the directory
+func sftpServer(dir string) func(ch ssh.Channel, typ, arg string) uint32 {
+	return func(ch ssh.Channel, typ, arg string) uint32 {
+		if typ != "subsystem" || arg != "sftp" {
+			return 127
+		}
+		server, err := sftp.NewServer(ch, sftp.WithServerWorkingDirectory(dir))
+		if err != nil {
+			return 1
+		}
+		server.Serve()
+		return 0
+	}
+}
+
+func TestSFTPTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+	remote := filepath.Join(dir, "remote")
+	for _, d := range []string{filepath.Join(local, "app", "logs"), remote} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	mtime := time.Unix(1500000000, 0)
+	files := map[string][]byte{"app/app.conf": []byte("hello"), "app/logs/today.log": content}
+	for name, data := range files {
+		file := filepath.Join(local, filepath.FromSlash(name))
+		if err := ioutil.WriteFile(file, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := newFileTransfer(transferServer(t, sftpServer(remote)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, ok := client.(*sftpTransfer); !ok {
+		t.Fatalf("Expected sftp to be used, got %T", client)
+	}
+
+	if err := client.Upload(filepath.Join(local, "app"), ".", false); err == nil {
+		t.Errorf("Expected a directory not to be copied without -r")
+	}
+	if err := client.Upload(filepath.Join(local, "app"), ".", true); err != nil {
+		t.Fatal(err)
+	}
+	downloaded := filepath.Join(dir, "downloaded")
+	if err := client.Download("app", downloaded, true); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		copies := []string{
+			filepath.Join(remote, filepath.FromSlash(name)),
+			filepath.Join(downloaded, filepath.FromSlash(strings.TrimPrefix(name, "app/"))),
+		}
+		for _, file := range copies {
+			got, err := ioutil.ReadFile(file)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("Expected %s to be copied, got %d bytes %v", file, len(got), err)
+				continue
+			}
+			info, err := os.Stat(file)
+			if err != nil || info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+				t.Errorf("Expected %s to keep its permissions and modification time, got %v", file, info)
+			}
+		}
+	}
+
+	if err := client.Download("missing", filepath.Join(dir, "missing"), false); err == nil || !strings.Contains(err.Error(), "not exist") {
+		t.Errorf("Expected an error for a missing file, got %v", err)
+	}
+}
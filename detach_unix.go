@@ -0,0 +1,48 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// detach starts the command in its own session so that it outlives the terminal
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// lockFile takes an exclusive lock on the file, which is released when the file is closed. It fails if another
+// process holds the lock.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// terminate asks the process to exit
+func terminate(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// privateDir creates the directory if needed and checks that it is a directory of the current user that no one else
+// can access, as another user could have created it in a shared location to hijack the sockets kept in it
+func privateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by another user", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s can be accessed by other users, expected mode 0700 but got %04o", dir, info.Mode().Perm())
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	detachedProcess       = 0x00000008
+	createNewProcessGroup = 0x00000200
+)
+
+// detach starts the command without a console so that it outlives the terminal
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: detachedProcess | createNewProcessGroup}
+}
+
+// lockFile takes an exclusive lock on the file, which is released when the file is closed. It fails if another
+// process holds the lock.
+func lockFile(f *os.File) error {
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	return windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+}
+
+// terminate stops the process, Windows has no signal to ask it to exit
+func terminate(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+// privateDir creates the directory if needed. The user cache directory is private to the user on Windows, where the
+// permission bits don't describe who can access a directory.
+func privateDir(dir string) error {
+	return os.MkdirAll(dir, 0700)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+)
+
+// fetchCaches returns the ElastiCache Redis replication groups and the Memcached and Redis clusters that are not part
+// of one. Replication groups are reached through their configuration or primary endpoint.
+func fetchCaches(config *aws.Config) ([]*endpoint, error) {
+	s := session.Must(session.NewSession(config))
+	svc := elasticache.New(s, &aws.Config{})
+
+	subnetVPCs := make(map[string]string)
+	err := svc.DescribeCacheSubnetGroupsPages(&elasticache.DescribeCacheSubnetGroupsInput{}, func(page *elasticache.DescribeCacheSubnetGroupsOutput, last bool) bool {
+		for _, g := range page.CacheSubnetGroups {
+			subnetVPCs[aws.StringValue(g.CacheSubnetGroupName)] = aws.StringValue(g.VpcId)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var clusters []*elasticache.CacheCluster
+	input := &elasticache.DescribeCacheClustersInput{ShowCacheNodeInfo: aws.Bool(true)}
+	err = svc.DescribeCacheClustersPages(input, func(page *elasticache.DescribeCacheClustersOutput, last bool) bool {
+		clusters = append(clusters, page.CacheClusters...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*elasticache.ReplicationGroup
+	err = svc.DescribeReplicationGroupsPages(&elasticache.DescribeReplicationGroupsInput{}, func(page *elasticache.DescribeReplicationGroupsOutput, last bool) bool {
+		groups = append(groups, page.ReplicationGroups...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cacheEndpoints(clusters, groups, subnetVPCs), nil
+}
+
+// cacheEndpoints returns an endpoint for every replication group and for every cluster that is not a member of one.
+// Groups don't have a subnet group of their own and are placed in the VPC of their member clusters.
+func cacheEndpoints(clusters []*elasticache.CacheCluster, groups []*elasticache.ReplicationGroup, subnetVPCs map[string]string) []*endpoint {
+	var caches []*endpoint
+	groupVPCs := make(map[string]string)
+	for _, c := range clusters {
+		vpcID := subnetVPCs[aws.StringValue(c.CacheSubnetGroupName)]
+		if c.ReplicationGroupId != nil {
+			groupVPCs[*c.ReplicationGroupId] = vpcID
+			continue
+		}
+		e := c.ConfigurationEndpoint
+		if e == nil && len(c.CacheNodes) > 0 {
+			e = c.CacheNodes[0].Endpoint
+		}
+		if e == nil {
+			// still being created
+			continue
+		}
+		caches = append(caches, &endpoint{
+			Type:   endpointCache,
+			ID:     aws.StringValue(c.CacheClusterId),
+			Engine: aws.StringValue(c.Engine),
+			Host:   aws.StringValue(e.Address),
+			Port:   int(aws.Int64Value(e.Port)),
+			VpcID:  vpcID,
+			Status: aws.StringValue(c.CacheClusterStatus),
+			TLS:    aws.BoolValue(c.TransitEncryptionEnabled),
+		})
+	}
+
+	for _, g := range groups {
+		e := g.ConfigurationEndpoint
+		if e == nil && len(g.NodeGroups) > 0 {
+			e = g.NodeGroups[0].PrimaryEndpoint
+		}
+		if e == nil {
+			continue
+		}
+		caches = append(caches, &endpoint{
+			Type:   endpointCache,
+			ID:     aws.StringValue(g.ReplicationGroupId),
+			Engine: "redis",
+			Host:   aws.StringValue(e.Address),
+			Port:   int(aws.Int64Value(e.Port)),
+			VpcID:  groupVPCs[aws.StringValue(g.ReplicationGroupId)],
+			Status: aws.StringValue(g.Status),
+			TLS:    aws.BoolValue(g.TransitEncryptionEnabled),
+		})
+	}
+	return caches
+}
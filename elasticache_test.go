@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+)
+
+func TestCacheEndpoints(t *testing.T) {
+	clusters := []*elasticache.CacheCluster{
+		{
+			CacheClusterId:       aws.String("sessions-001"),
+			ReplicationGroupId:   aws.String("sessions"),
+			CacheSubnetGroupName: aws.String("prod"),
+		},
+		{
+			CacheClusterId:       aws.String("pages"),
+			Engine:               aws.String("memcached"),
+			CacheSubnetGroupName: aws.String("staging"),
+			ConfigurationEndpoint: &elasticache.Endpoint{
+				Address: aws.String("pages.cfg.cache.amazonaws.com"),
+				Port:    aws.Int64(11211),
+			},
+		},
+		{
+			CacheClusterId:       aws.String("queue"),
+			Engine:               aws.String("redis"),
+			CacheSubnetGroupName: aws.String("prod"),
+			CacheNodes: []*elasticache.CacheNode{{Endpoint: &elasticache.Endpoint{
+				Address: aws.String("queue.0001.cache.amazonaws.com"),
+				Port:    aws.Int64(6379),
+			}}},
+			TransitEncryptionEnabled: aws.Bool(true),
+		},
+		{CacheClusterId: aws.String("creating"), Engine: aws.String("redis")},
+	}
+	groups := []*elasticache.ReplicationGroup{
+		{
+			ReplicationGroupId: aws.String("sessions"),
+			NodeGroups: []*elasticache.NodeGroup{{PrimaryEndpoint: &elasticache.Endpoint{
+				Address: aws.String("sessions.primary.cache.amazonaws.com"),
+				Port:    aws.Int64(6379),
+			}}},
+		},
+		{ReplicationGroupId: aws.String("creating")},
+	}
+	subnetVPCs := map[string]string{"prod": "vpc-prod", "staging": "vpc-staging"}
+
+	expected := []endpoint{
+		{Type: endpointCache, ID: "pages", Engine: "memcached", Host: "pages.cfg.cache.amazonaws.com", Port: 11211, VpcID: "vpc-staging"},
+		{Type: endpointCache, ID: "queue", Engine: "redis", Host: "queue.0001.cache.amazonaws.com", Port: 6379, VpcID: "vpc-prod", TLS: true},
+		{Type: endpointCache, ID: "sessions", Engine: "redis", Host: "sessions.primary.cache.amazonaws.com", Port: 6379, VpcID: "vpc-prod"},
+	}
+	caches := cacheEndpoints(clusters, groups, subnetVPCs)
+	if len(caches) != len(expected) {
+		t.Fatalf("Expected %d endpoints, got %+v", len(expected), caches)
+	}
+	for n, e := range expected {
+		if *caches[n] != e {
+			t.Errorf("Expected %+v, got %+v", e, *caches[n])
+		}
+	}
+}
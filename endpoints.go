@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Endpoint types
+const (
+	endpointRDS   = "rds"
+	endpointCache = "elasticache"
+	endpointALB   = "alb"
+	endpointNLB   = "nlb"
+)
+
+// endpointKinds are the commands that discover endpoints with the fetchers for the endpoint types they list
+var endpointKinds = map[string][]func(*aws.Config) ([]*endpoint, error){
+	"db":       {fetchDatabases},
+	"cache":    {fetchCaches},
+	"lb":       {fetchLoadBalancers},
+	"endpoint": {fetchDatabases, fetchCaches, fetchLoadBalancers},
+}
+
+// endpoint is a managed service in a private subnet that is reached through a bastion in the same VPC
+type endpoint struct {
+	Type   string
+	ID     string
+	Engine string
+	Host   string
+	Port   int
+	VpcID  string
+	Status string
+	TLS    bool
+	// User and Database are the defaults for the connection string
+	User     string
+	Database string
+}
+
+// Address is the host and port of the endpoint
+func (e *endpoint) Address() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// fetchEndpoints returns the endpoints of the kind. If a kind has more than one type of endpoint, the types that
+// can't be listed, e.g. for lack of permissions, are skipped with a warning.
+func fetchEndpoints(config *aws.Config, kind string) ([]*endpoint, error) {
+	fetchers := endpointKinds[kind]
+	var endpoints []*endpoint
+	for _, fetch := range fetchers {
+		found, err := fetch(config)
+		if err != nil && len(fetchers) == 1 {
+			return nil, err
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[!] %s\n", err)
+			continue
+		}
+		endpoints = append(endpoints, found...)
+	}
+	return endpoints, nil
+}
+
+// endpointURL is the connection string for the endpoint at the local end of the forward
+func endpointURL(e *endpoint, user, database, host string, port int) string {
+	hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+	switch e.Type {
+	case endpointRDS:
+		return databaseURL(e, user, database, host, port)
+	case endpointCache:
+		if e.Engine != "redis" {
+			return hostPort
+		}
+		if e.TLS {
+			return "rediss://" + hostPort
+		}
+		return "redis://" + hostPort
+	}
+	switch e.Engine {
+	case "http":
+		return "http://" + hostPort
+	case "https", "tls":
+		// the certificate is for the name of the load balancer, which has to resolve to the local end of the forward
+		name := net.JoinHostPort(e.Host, strconv.Itoa(port))
+		return fmt.Sprintf("https://%s with %s resolving to %s, e.g. curl --resolve %s:%s https://%s", name, e.Host, host, name, host, name)
+	}
+	return hostPort
+}
+
+// findEndpoints returns the endpoints whose ID fuzzy matches the search term, or all of them if there is none
+func findEndpoints(term string, endpoints []*endpoint) []*endpoint {
+	var found []*endpoint
+	if term == "" {
+		found = append(found, endpoints...)
+	} else {
+		var ids []string
+		for _, e := range endpoints {
+			ids = append(ids, e.ID)
+		}
+		matches := make(map[string]bool)
+		for _, id := range fuzzyNames(term, ids) {
+			matches[id] = true
+		}
+		for _, e := range endpoints {
+			if matches[e.ID] {
+				found = append(found, e)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Type != found[j].Type {
+			return found[i].Type < found[j].Type
+		}
+		return found[i].ID < found[j].ID
+	})
+	return found
+}
+
+// pickEndpoint asks which endpoint to connect to, unless there is only one and autoJump is set
+func pickEndpoint(endpoints []*endpoint, autoJump bool) *endpoint {
+	if autoJump && len(endpoints) == 1 {
+		return endpoints[0]
+	}
+	longestID := 0
+	for _, e := range endpoints {
+		if len(e.ID) > longestID {
+			longestID = len(e.ID)
+		}
+	}
+	for idx, e := range endpoints {
+		fmt.Printf("%3d. %-11s %s %-18s %-10s %s\n", idx+1, e.Type, padToLen(e.ID, " ", longestID), e.Engine, e.Status, e.Address())
+	}
+
+	fmt.Print("[?] Pick endpoint # and then [enter] to continue: ")
+
+	reader := bufio.NewReader(os.Stdin)
+	index, _ := reader.ReadString('\n')
+
+	id, err := strconv.Atoi(strings.TrimSpace(index))
+	if err != nil || id < 1 || id > len(endpoints) {
+		fmt.Println("[!] I cannot do that Dave.")
+		os.Exit(1)
+	}
+	return endpoints[id-1]
+}
+
+// bastionInVPC picks one of the bastions in the VPC at random
+func bastionInVPC(instances []*instance, vpcID string) (*instance, error) {
+	var bastions []*instance
+	for _, i := range instances {
+		if i.IsNat && i.VpcID == vpcID && i.PublicIP != "" {
+			bastions = append(bastions, i)
+		}
+	}
+	if len(bastions) == 0 {
+		return nil, fmt.Errorf("no bastion found in %s", vpcID)
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return bastions[random.Intn(len(bastions))], nil
+}
+
+// forwardEndpoint forwards the local port to the endpoint through a bastion in its VPC until interrupted. The
+// connection string is printed once the forward is listening.
+func forwardEndpoint(cfg *tunnelConfig, instances []*instance, e *endpoint, localPort int, connectionString func(host string, port int) string) error {
+	if e.VpcID == "" {
+		return fmt.Errorf("the VPC of %s is not known", e.ID)
+	}
+	bastion, err := bastionInVPC(instances, e.VpcID)
+	if err != nil {
+		return err
+	}
+	if localPort == 0 {
+		localPort = e.Port
+	}
+
+	fmt.Printf("[+] connecting to %s via %s@%s\n", e.ID, cfg.BastionUser, bastion.PublicIP)
+	tunnelClient, _, err := cfg.tunnel(bastion)
+	if err != nil {
+		return err
+	}
+	defer cfg.Close()
+
+	host := "127.0.0.1"
+	spec := &forwardSpec{
+		ListenNetwork: "tcp",
+		ListenAddr:    net.JoinHostPort(host, strconv.Itoa(localPort)),
+		DialNetwork:   "tcp",
+		DialAddr:      e.Address(),
+	}
+	l, err := localForward(&sshForwardingClient{false, tunnelClient, false}, spec)
+	if err != nil {
+		return fmt.Errorf("%s, use -port to listen on another port", err)
+	}
+	defer l.Close()
+	if s := connectionString(host, localPort); s != "" {
+		fmt.Printf("[+] %s\n", s)
+	}
+	fmt.Println("[+] press Ctrl-C to stop")
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	lost := make(chan error, 1)
+	go func() {
+		tunnelClient.Wait()
+		lost <- errors.New("connection to the bastion lost")
+	}()
+	select {
+	case <-interrupt:
+		return nil
+	case err := <-lost:
+		return err
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestEndpointURL(t *testing.T) {
+	tests := []struct {
+		endpoint *endpoint
+		expected string
+	}{
+		{&endpoint{Type: endpointRDS, Engine: "postgres"}, "postgresql://app@127.0.0.1:6000/orders"},
+		{&endpoint{Type: endpointCache, Engine: "redis"}, "redis://127.0.0.1:6000"},
+		{&endpoint{Type: endpointCache, Engine: "redis", TLS: true}, "rediss://127.0.0.1:6000"},
+		{&endpoint{Type: endpointCache, Engine: "memcached"}, "127.0.0.1:6000"},
+		{&endpoint{Type: endpointALB, Engine: "http", Host: "internal-api.elb.amazonaws.com"}, "http://127.0.0.1:6000"},
+		{&endpoint{Type: endpointALB, Engine: "https", Host: "internal-api.elb.amazonaws.com"}, "https://internal-api.elb.amazonaws.com:6000 with internal-api.elb.amazonaws.com resolving to 127.0.0.1, e.g. curl --resolve internal-api.elb.amazonaws.com:6000:127.0.0.1 https://internal-api.elb.amazonaws.com:6000"},
+		{&endpoint{Type: endpointNLB, Engine: "tcp"}, "127.0.0.1:6000"},
+	}
+	for _, test := range tests {
+		if got := endpointURL(test.endpoint, "app", "orders", "127.0.0.1", 6000); got != test.expected {
+			t.Errorf("Expected %s for %s %s, got %s", test.expected, test.endpoint.Type, test.endpoint.Engine, got)
+		}
+	}
+
+	found := findEndpoints("orders", []*endpoint{
+		{Type: endpointRDS, ID: "orders"},
+		{Type: endpointALB, ID: "orders"},
+		{Type: endpointCache, ID: "orders"},
+	})
+	if len(found) != 3 || found[0].Type != endpointALB || found[1].Type != endpointCache || found[2].Type != endpointRDS {
+		t.Errorf("Expected endpoints with the same ID to be ordered by type, got %+v", found)
+	}
+}
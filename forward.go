@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// stringList is a flag.Value that can be given multiple times
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ", ") }
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// forwardSpec describes a port forward between a listen address on one side of the tunnel and a dial address on
+// the other side. Either address can be a TCP host:port or a unix socket path.
+type forwardSpec struct {
+	ListenNetwork string
+	ListenAddr    string
+	DialNetwork   string
+	DialAddr      string
+}
+
+func (f *forwardSpec) String() string {
+	return fmt.Sprintf("%s -> %s", f.ListenAddr, f.DialAddr)
+}
+
+// parseForward parses a forward in the OpenSSH format [bind_address:]port:host:hostport. Unix sockets are given as
+// absolute paths in place of a port or host:hostport, e.g. 2375:/var/run/docker.sock or
+// /tmp/pg.sock:/var/run/postgresql/.s.PGSQL.5432. The bind address defaults to localhost, IPv6 addresses are given in
+// brackets, e.g. [::1]:8080:[fd00::1]:80.
+func parseForward(spec string) (*forwardSpec, error) {
+	f := &forwardSpec{ListenNetwork: "tcp", DialNetwork: "tcp"}
+	parts, err := splitForward(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// the dial side is either a trailing socket path or the trailing host:hostport
+	var listen []string
+	if last := parts[len(parts)-1]; isSocketPath(last) {
+		f.DialNetwork = "unix"
+		f.DialAddr = last
+		listen = parts[:len(parts)-1]
+	} else if len(parts) >= 3 {
+		f.DialAddr = net.JoinHostPort(parts[len(parts)-2], last)
+		listen = parts[:len(parts)-2]
+	}
+
+	switch {
+	case len(listen) == 1 && isSocketPath(listen[0]):
+		f.ListenNetwork = "unix"
+		f.ListenAddr = listen[0]
+	case len(listen) == 1:
+		f.ListenAddr = net.JoinHostPort("localhost", listen[0])
+	case len(listen) == 2:
+		f.ListenAddr = net.JoinHostPort(listen[0], listen[1])
+	default:
+		return nil, fmt.Errorf("invalid forward %q, expected [bind_address:]port:host:hostport", spec)
+	}
+	return f, nil
+}
+
+// splitForward splits a forward on the colons outside of brackets and drops the brackets, like OpenSSH does
+func splitForward(spec string) ([]string, error) {
+	var parts []string
+	for rest := spec; ; {
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 || (end+1 < len(rest) && rest[end+1] != ':') {
+				return nil, fmt.Errorf("invalid forward %q, unterminated or misplaced brackets", spec)
+			}
+			parts = append(parts, rest[1:end])
+			if end+1 == len(rest) {
+				return parts, nil
+			}
+			rest = rest[end+2:]
+			continue
+		}
+		i := strings.Index(rest, ":")
+		if i < 0 {
+			return append(parts, rest), nil
+		}
+		parts = append(parts, rest[:i])
+		rest = rest[i+1:]
+	}
+}
+
+func isSocketPath(s string) bool {
+	return strings.HasPrefix(s, "/")
+}
+
+// localForward listens on the local listen address and forwards every accepted connection through the SSH client
+// to the dial address, as seen from the target instance. Closing the returned listener stops the forward.
+func localForward(client *sshForwardingClient, spec *forwardSpec) (net.Listener, error) {
+	listener, err := net.Listen(spec.ListenNetwork, spec.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("[+] forwarding %s\n", spec)
+	go serveForward(listener, spec, client.Dial)
+	return listener, nil
+}
+
+// remoteForward asks the target instance to listen on the listen address and forwards every connection it receives
+// back to the dial address on this machine. Closing the returned listener cancels the forward on the target.
+func remoteForward(client *sshForwardingClient, spec *forwardSpec) (net.Listener, error) {
+	listener, err := client.Listen(spec.ListenNetwork, spec.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("remote forward %s: %s", spec, err)
+	}
+	fmt.Printf("[+] remote forwarding %s\n", spec)
+	go serveForward(listener, spec, net.Dial)
+	return listener, nil
+}
+
+// serveForward accepts connections until the listener is closed and pipes each one to a connection from dial
+func serveForward(listener net.Listener, spec *forwardSpec, dial func(network, addr string) (net.Conn, error)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			target, err := dial(spec.DialNetwork, spec.DialAddr)
+			if err != nil {
+				fmt.Printf("[!] forward to %s failed: %s\r\n", spec.DialAddr, err)
+				conn.Close()
+				return
+			}
+			pipe(conn, target)
+		}()
+	}
+}
+
+// forwardSet holds the forwards and proxies given on the command line
+type forwardSet struct {
+	Local     []*forwardSpec
+	Remote    []*forwardSpec
+	Socks     string
+	HTTPProxy string
+	Allow     *allowList
+}
+
+func newForwardSet(local, remote []string, socks, httpProxy string, allow []string) (*forwardSet, error) {
+	f := &forwardSet{}
+	for _, l := range local {
+		spec, err := parseForward(l)
+		if err != nil {
+			return nil, err
+		}
+		f.Local = append(f.Local, spec)
+	}
+	for _, r := range remote {
+		spec, err := parseForward(r)
+		if err != nil {
+			return nil, err
+		}
+		f.Remote = append(f.Remote, spec)
+	}
+	var err error
+	if socks != "" {
+		if f.Socks, err = parseListenAddr(socks); err != nil {
+			return nil, err
+		}
+	}
+	if httpProxy != "" {
+		if f.HTTPProxy, err = parseListenAddr(httpProxy); err != nil {
+			return nil, err
+		}
+	}
+	if f.Allow, err = newAllowList(allow); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Empty reports whether there is nothing to forward
+func (f *forwardSet) Empty() bool {
+	return len(f.Local) == 0 && len(f.Remote) == 0 && f.Socks == "" && f.HTTPProxy == ""
+}
+
+// Start opens all forwards and proxies over the client. If one fails the ones already opened are closed again.
+func (f *forwardSet) Start(client *sshForwardingClient) ([]io.Closer, error) {
+	var listeners []io.Closer
+	add := func(l net.Listener, err error) error {
+		if err != nil {
+			closeAll(listeners)
+			return err
+		}
+		listeners = append(listeners, l)
+		return nil
+	}
+	for _, spec := range f.Local {
+		if err := add(localForward(client, spec)); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range f.Remote {
+		if err := add(remoteForward(client, spec)); err != nil {
+			return nil, err
+		}
+	}
+	if f.Socks != "" {
+		if err := add(socksProxy(client, f.Socks)); err != nil {
+			return nil, err
+		}
+	}
+	if f.HTTPProxy != "" {
+		if err := add(startHTTPProxy(client, f.HTTPProxy, f.Allow)); err != nil {
+			return nil, err
+		}
+	}
+	return listeners, nil
+}
+
+// String describes the forwards for listings
+func (f *forwardSet) String() string {
+	var parts []string
+	for _, spec := range f.Local {
+		parts = append(parts, "-L "+spec.String())
+	}
+	for _, spec := range f.Remote {
+		parts = append(parts, "-R "+spec.String())
+	}
+	if f.Socks != "" {
+		parts = append(parts, "-D "+f.Socks)
+	}
+	if f.HTTPProxy != "" {
+		parts = append(parts, "-http-proxy "+f.HTTPProxy)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// closeAll closes all the closers, ignoring any errors
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+// pipe copies data in both directions between the two connections and closes both once either side is done
+func pipe(a, b io.ReadWriteCloser) {
+	var once sync.Once
+	closer := func() {
+		a.Close()
+		b.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		once.Do(closer)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		once.Do(closer)
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec          string
+		listenNetwork string
+		listen        string
+		dialNetwork   string
+		dial          string
+	}{
+		{"8080:localhost:80", "tcp", "localhost:8080", "tcp", "localhost:80"},
+		{"0.0.0.0:5432:db.internal:5432", "tcp", "0.0.0.0:5432", "tcp", "db.internal:5432"},
+		{"2375:/var/run/docker.sock", "tcp", "localhost:2375", "unix", "/var/run/docker.sock"},
+		{"/tmp/pg.sock:/var/run/postgresql/.s.PGSQL.5432", "unix", "/tmp/pg.sock", "unix", "/var/run/postgresql/.s.PGSQL.5432"},
+		{"/tmp/web.sock:localhost:80", "unix", "/tmp/web.sock", "tcp", "localhost:80"},
+		{"[::1]:8080:localhost:80", "tcp", "[::1]:8080", "tcp", "localhost:80"},
+		{"8080:[fd00::1]:80", "tcp", "localhost:8080", "tcp", "[fd00::1]:80"},
+		{"[::]:8080:[fd00::1]:80", "tcp", "[::]:8080", "tcp", "[fd00::1]:80"},
+		{"[::1]:2375:/var/run/docker.sock", "tcp", "[::1]:2375", "unix", "/var/run/docker.sock"},
+	}
+
+	for _, test := range tests {
+		actual, err := parseForward(test.spec)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s", test.spec, err)
+			continue
+		}
+		if actual.ListenNetwork != test.listenNetwork || actual.DialNetwork != test.dialNetwork {
+			t.Errorf("Expected networks %s -> %s for %q, got %s -> %s", test.listenNetwork, test.dialNetwork, test.spec, actual.ListenNetwork, actual.DialNetwork)
+		}
+		if actual.ListenAddr != test.listen {
+			t.Errorf("Expected listen address %s, got %s", test.listen, actual.ListenAddr)
+		}
+		if actual.DialAddr != test.dial {
+			t.Errorf("Expected dial address %s, got %s", test.dial, actual.DialAddr)
+		}
+	}
+
+	for _, spec := range []string{"8080", "localhost:80", "a:b:8080:localhost:80", "[::1:8080:localhost:80", "[::1]8080:localhost:80", "::1:8080:localhost:80"} {
+		if _, err := parseForward(spec); err == nil {
+			t.Errorf("Expected error for invalid forward %q", spec)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key checking modes
+const (
+	hostKeyStrict   = "strict"
+	hostKeyAsk      = "ask"
+	hostKeyInsecure = "off"
+)
+
+// defaultKnownHostsPath is the OpenSSH user known hosts file
+func defaultKnownHostsPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "known_hosts"
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// hostKeyVerifier checks host keys against a known_hosts file. Unknown hosts are rejected in strict mode, and in ask
+// mode the user is asked to trust the key on first use, after which it is recorded in the file. A key that differs
+// from the recorded one is always rejected. If Console is set, keys found in the console output of an instance are
+// trusted before known_hosts is consulted. Host certificates signed by one of the Authorities are trusted without
+// either, other certificates are treated like the plain key they certify.
+type hostKeyVerifier struct {
+	File        string
+	Mode        string
+	Console     *consoleHostKeys
+	Authorities []ssh.PublicKey
+	// Deferred rejects unknown keys without asking, so that the client of the daemon can ask on its terminal
+	Deferred bool
+
+	mu       sync.Mutex
+	rejected map[string]error
+}
+
+func newHostKeyVerifier(file, mode string) (*hostKeyVerifier, error) {
+	switch mode {
+	case hostKeyStrict, hostKeyAsk, hostKeyInsecure:
+	default:
+		return nil, fmt.Errorf("invalid host key check %q, expected %s, %s or %s", mode, hostKeyStrict, hostKeyAsk, hostKeyInsecure)
+	}
+	return &hostKeyVerifier{File: file, Mode: mode, rejected: make(map[string]error)}, nil
+}
+
+// Callback returns the ssh.HostKeyCallback for connections to the instance
+func (v *hostKeyVerifier) Callback(instanceID string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if v.Mode == hostKeyInsecure {
+			return nil
+		}
+		if cert, ok := key.(*ssh.Certificate); ok {
+			if v.isAuthority(cert.SignatureKey) {
+				checker := &ssh.CertChecker{
+					IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+						return v.isAuthority(auth)
+					},
+				}
+				if err := checker.CheckHostKey(hostname, remote, cert); err != nil {
+					return v.reject(hostname, fmt.Errorf("host certificate %q of %s is invalid: %s", cert.KeyId, knownhosts.Normalize(hostname), strings.TrimPrefix(err.Error(), "ssh: ")))
+				}
+				return nil
+			}
+			key = cert.Key
+		}
+		if v.Console != nil && instanceID != "" {
+			trusted, err := v.Console.Verify(instanceID, key)
+			if err != nil {
+				return v.reject(hostname, err)
+			}
+			if trusted {
+				return nil
+			}
+		}
+		return v.Check(hostname, remote, key)
+	}
+}
+
+func (v *hostKeyVerifier) isAuthority(key ssh.PublicKey) bool {
+	return containsKey(v.Authorities, key)
+}
+
+func (v *hostKeyVerifier) reject(hostname string, err error) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.rejected[hostname] = err
+	return err
+}
+
+// Check is a ssh.HostKeyCallback that verifies the key against known_hosts
+func (v *hostKeyVerifier) Check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if v.Mode == hostKeyInsecure {
+		return nil
+	}
+
+	// serialise checks so that a key accepted for one connection is seen by the next
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// don't ask twice about a host that was already rejected, e.g. when retrying with another user
+	if err, ok := v.rejected[hostname]; ok {
+		return err
+	}
+	err := v.check(hostname, remote, key)
+	if _, unknown := err.(*unknownHostKeyError); err != nil && !(unknown && v.Deferred) {
+		v.rejected[hostname] = err
+	}
+	return err
+}
+
+func (v *hostKeyVerifier) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	err := v.checkKnownHosts(hostname, remote, key)
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return err
+	}
+	if len(keyErr.Want) > 0 {
+		return hostKeyChangedError(hostname, key, keyErr.Want)
+	}
+
+	host := knownhosts.Normalize(hostname)
+	if v.Mode == hostKeyStrict || v.Deferred {
+		return &unknownHostKeyError{Hostname: hostname, Remote: remote, Key: key, File: v.File}
+	}
+
+	question := fmt.Sprintf("[?] The authenticity of host '%s' can't be established.\n    %s key fingerprint is %s.\n    Are you sure you want to continue connecting?", host, key.Type(), ssh.FingerprintSHA256(key))
+	yes, err := confirm(question)
+	if err != nil {
+		return fmt.Errorf("host key for %s is not known: %s", host, err)
+	}
+	if !yes {
+		return fmt.Errorf("host key for %s was not accepted", host)
+	}
+	return v.add(hostname, key)
+}
+
+func (v *hostKeyVerifier) checkKnownHosts(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	var files []string
+	if _, err := os.Stat(v.File); err == nil {
+		files = append(files, v.File)
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return err
+	}
+	return callback(hostname, remote, key)
+}
+
+// add appends the key for the host to the known hosts file
+func (v *hostKeyVerifier) add(hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(v.File), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(v.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{hostname}, key)); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "[+] added %s to %s\n", knownhosts.Normalize(hostname), v.File)
+	return nil
+}
+
+// unknownHostKeyError is returned for a host that isn't in the known hosts file when the user can't be asked
+type unknownHostKeyError struct {
+	Hostname string
+	Remote   net.Addr
+	Key      ssh.PublicKey
+	File     string
+}
+
+func (e *unknownHostKeyError) Error() string {
+	return fmt.Sprintf("host key for %s is not known (%s %s), add it to %s or use -host-key-check %s", knownhosts.Normalize(e.Hostname), e.Key.Type(), ssh.FingerprintSHA256(e.Key), e.File, hostKeyAsk)
+}
+
+// hostKeyChangedError is the loud warning for a host that presents a different key than the one on record
+func hostKeyChangedError(hostname string, key ssh.PublicKey, known []knownhosts.KnownKey) error {
+	var lines []string
+	lines = append(lines,
+		"@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@",
+		"@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @",
+		"@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@",
+		"IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!",
+		fmt.Sprintf("Host %s presented %s key %s", knownhosts.Normalize(hostname), key.Type(), ssh.FingerprintSHA256(key)),
+	)
+	for _, k := range known {
+		lines = append(lines, fmt.Sprintf("but %s:%d has %s key %s", k.Filename, k.Line, k.Key.Type(), ssh.FingerprintSHA256(k.Key)))
+	}
+	lines = append(lines, "Remove the old entry if the change is expected.")
+	return fmt.Errorf("%s", strings.Join(lines, "\n"))
+}
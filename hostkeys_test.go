@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func testHostKey(t *testing.T) ssh.PublicKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestHostKeyVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "known_hosts")
+
+	known := testHostKey(t)
+	other := testHostKey(t)
+	line := knownhosts.Line([]string{"10.0.0.1:22"}, known) + "\n"
+	if err := ioutil.WriteFile(file, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	v, err := newHostKeyVerifier(file, hostKeyStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Check("10.0.0.1:22", addr, known); err != nil {
+		t.Errorf("Expected the known key to be accepted, got %s", err)
+	}
+	if err := v.Check("10.0.0.2:22", addr, known); err == nil {
+		t.Errorf("Expected an unknown host to be rejected in strict mode")
+	}
+	if _, ok := v.rejected["10.0.0.1:22"]; ok || len(v.rejected) != 1 {
+		t.Errorf("Expected only the unknown host to be recorded as rejected")
+	}
+
+	err = v.Check("10.0.0.1:22", addr, other)
+	if err == nil {
+		t.Fatal("Expected a changed key to be rejected")
+	}
+	for _, fp := range []string{ssh.FingerprintSHA256(known), ssh.FingerprintSHA256(other)} {
+		if !strings.Contains(err.Error(), fp) {
+			t.Errorf("Expected the error to contain fingerprint %s, got %s", fp, err)
+		}
+	}
+
+	if _, err := newHostKeyVerifier(file, "maybe"); err == nil {
+		t.Errorf("Expected an error for an invalid mode")
+	}
+}
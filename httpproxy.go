@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are removed from forwarded requests and responses, see RFC 7230 section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// allowList restricts which destinations the HTTP proxy will connect to. An empty list allows everything.
+type allowList struct {
+	networks []*net.IPNet
+	hosts    []string
+}
+
+// newAllowList parses entries that are either CIDRs (10.0.0.0/16), host names (api.internal) or domain wildcards
+// (*.internal)
+func newAllowList(entries []string) (*allowList, error) {
+	a := &allowList{}
+	for _, entry := range entries {
+		for _, e := range strings.Split(entry, ",") {
+			e = strings.TrimSpace(e)
+			if e == "" {
+				continue
+			}
+			if strings.Contains(e, "/") {
+				_, network, err := net.ParseCIDR(e)
+				if err != nil {
+					return nil, err
+				}
+				a.networks = append(a.networks, network)
+				continue
+			}
+			if ip := net.ParseIP(e); ip != nil {
+				a.networks = append(a.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+				continue
+			}
+			a.hosts = append(a.hosts, strings.ToLower(e))
+		}
+	}
+	return a, nil
+}
+
+// Allowed reports whether the host (without port) may be connected to
+func (a *allowList) Allowed(host string) bool {
+	if len(a.networks) == 0 && len(a.hosts) == 0 {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range a.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, h := range a.hosts {
+		if h == host {
+			return true
+		}
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpProxy is a forward HTTP proxy that dials every destination through the SSH client
+type httpProxy struct {
+	client    *sshForwardingClient
+	allow     *allowList
+	transport *http.Transport
+}
+
+// startHTTPProxy starts a HTTP proxy on the listen address that supports CONNECT tunnels and plain HTTP forward
+// requests. Closing the returned listener stops the proxy.
+func startHTTPProxy(client *sshForwardingClient, listenAddr string, allow *allowList) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &httpProxy{
+		client: client,
+		allow:  allow,
+		transport: &http.Transport{
+			Dial: client.Dial,
+			// never honour HTTP_PROXY and friends, they are likely to point back at us
+			Proxy: nil,
+		},
+	}
+	fmt.Printf("[+] HTTP proxy listening on %s\n", listener.Addr())
+	go http.Serve(listener, proxy)
+	return listener, nil
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Hostname()
+	if r.Method == http.MethodConnect {
+		host = hostOnly(r.Host)
+	}
+	if !p.allow.Allowed(host) {
+		fmt.Printf("[!] http proxy: denied %s %s\r\n", r.Method, r.Host)
+		http.Error(w, fmt.Sprintf("destination %s is not allowed", host), http.StatusForbidden)
+		return
+	}
+
+	fmt.Printf("[+] http proxy: %s %s\r\n", r.Method, r.Host)
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	p.forward(w, r)
+}
+
+// connect establishes a tunnel to the requested host and hands over the client connection
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := p.client.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		target.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		target.Close()
+		conn.Close()
+		return
+	}
+	pipe(&bufferedConn{conn, buf.Reader}, target)
+}
+
+// forward sends a plain HTTP request to its destination and copies back the response
+func (p *httpProxy) forward(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy, requests must use absolute URLs", http.StatusBadRequest)
+		return
+	}
+
+	out := r.WithContext(r.Context())
+	out.RequestURI = ""
+	out.Header = cloneHeader(r.Header)
+	removeHopHeaders(out.Header)
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for k, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// hostOnly strips the port from a host:port, if there is one
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAllowList(t *testing.T) {
+	allow, err := newAllowList([]string{"10.0.0.0/16,*.internal", "api.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"10.0.3.4", true},
+		{"10.1.0.1", false},
+		{"db.internal", true},
+		{"internal", false},
+		{"API.example.com", true},
+		{"www.example.com", false},
+	}
+	for _, test := range tests {
+		if actual := allow.Allowed(test.host); actual != test.allowed {
+			t.Errorf("Expected Allowed(%q) to be %t, got %t", test.host, test.allowed, actual)
+		}
+	}
+
+	empty, _ := newAllowList(nil)
+	if !empty.Allowed("anything.example.com") {
+		t.Errorf("Expected an empty allow list to allow everything")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// defaultIdentityFiles returns the private keys in ~/.ssh that OpenSSH tries by default
+func defaultIdentityFiles() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, name := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+		file := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// newIdentityAgent loads the identity files into an in-memory agent, which takes the place of the ssh-agent for
+// authentication and agent forwarding. A certificate next to an identity file is loaded with it. Default identities
+// that can't be loaded are skipped with a warning, as OpenSSH does.
+func newIdentityAgent(files []string, defaults bool) (agent.Agent, error) {
+	keyring := agent.NewKeyring()
+	for _, file := range files {
+		err := addIdentity(keyring, file)
+		if err != nil && defaults {
+			fmt.Fprintf(os.Stderr, "[!] skipping identity %s\n", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keyring, nil
+}
+
+// addIdentity adds the private key and its certificate, if there is one, to the keyring
+func addIdentity(keyring agent.Agent, file string) error {
+	key, err := loadPrivateKey(file)
+	if err != nil {
+		return err
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: file}); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	certFile := file + "-cert.pub"
+	if _, err := os.Stat(certFile); err != nil {
+		return nil
+	}
+	keys, err := loadPublicKeys(certFile)
+	if err != nil {
+		return err
+	}
+	if cert, ok := keys[0].(*ssh.Certificate); ok {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Certificate: cert, Comment: certFile}); err != nil {
+			return fmt.Errorf("%s: %s", certFile, err)
+		}
+	}
+	return nil
+}
+
+// keysEnv tells a background process started by salio to read the private keys it needs from stdin, as it has no
+// terminal to ask for passphrases on
+const keysEnv = "SALIO_KEYS"
+
+// loadedKeys are the private keys that have been loaded by file name, so that each is only asked for once
+var (
+	loadedKeysMu sync.Mutex
+	loadedKeys   = make(map[string]interface{})
+)
+
+// loadPrivateKey reads a private key file, asking for the passphrase on the terminal if the key is encrypted
+func loadPrivateKey(file string) (interface{}, error) {
+	loadedKeysMu.Lock()
+	key, ok := loadedKeys[file]
+	loadedKeysMu.Unlock()
+	if ok {
+		return key, nil
+	}
+	key, err := readPrivateKey(file)
+	if err != nil {
+		return nil, err
+	}
+	loadedKeysMu.Lock()
+	loadedKeys[file] = key
+	loadedKeysMu.Unlock()
+	return key, nil
+}
+
+func readPrivateKey(file string) (interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParseRawPrivateKey(data)
+	if _, encrypted := err.(*ssh.PassphraseMissingError); !encrypted {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		return key, nil
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		passphrase, err := readPassword(fmt.Sprintf("[?] Enter passphrase for %s: ", file))
+		if err != nil {
+			return nil, fmt.Errorf("%s is encrypted: %s", file, err)
+		}
+		key, err := ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+		if err == x509.IncorrectPasswordError {
+			fmt.Fprintln(os.Stderr, "[!] incorrect passphrase")
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: %s", file, x509.IncorrectPasswordError)
+}
+
+// keyFileArgs returns the private key files named by -i and -ca-key in the arguments
+func keyFileArgs(args []string) []string {
+	var files []string
+	for i, arg := range args {
+		switch {
+		case arg == "-i" && i+1 < len(args):
+			files = append(files, args[i+1])
+		case strings.HasPrefix(arg, "-ca-key="):
+			if file := strings.TrimPrefix(arg, "-ca-key="); file != "" && !strings.HasPrefix(file, agentKeyPrefix) {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+// startWithKeys starts a background process and hands it the loaded private keys and those named in its arguments
+// on stdin. Encrypted keys are asked for on the terminal now, as the process won't have one.
+func startWithKeys(cmd *exec.Cmd) error {
+	for _, file := range keyFileArgs(cmd.Args) {
+		if _, err := loadPrivateKey(file); err != nil {
+			return err
+		}
+	}
+
+	keys, err := marshalLoadedKeys()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	cmd.Stdin = r
+	cmd.Env = append(os.Environ(), keysEnv+"=1")
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(keys)
+	return err
+}
+
+// marshalLoadedKeys encodes the loaded private keys unencrypted for receiveKeys
+func marshalLoadedKeys() ([]byte, error) {
+	loadedKeysMu.Lock()
+	defer loadedKeysMu.Unlock()
+	var keys bytes.Buffer
+	for file, key := range loadedKeys {
+		// keys parsed from OpenSSH files are pointers, which MarshalPrivateKey doesn't take
+		if k, ok := key.(*ed25519.PrivateKey); ok {
+			key = *k
+		}
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		block.Headers = map[string]string{"File": file}
+		if err := pem.Encode(&keys, block); err != nil {
+			return nil, err
+		}
+	}
+	return keys.Bytes(), nil
+}
+
+// receiveKeys reads the private keys handed to this process by startWithKeys
+func receiveKeys(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		file := block.Headers["File"]
+		key, err := ssh.ParseRawPrivateKey(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes}))
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		loadedKeysMu.Lock()
+		loadedKeys[file] = key
+		loadedKeysMu.Unlock()
+		data = rest
+	}
+}
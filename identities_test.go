@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewIdentityAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usable := filepath.Join(dir, "id_ed25519")
+	unusable := filepath.Join(dir, "id_rsa")
+	if err := ioutil.WriteFile(usable, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(unusable, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := newIdentityAgent([]string{unusable, usable}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := keyring.List(); len(keys) != 1 || keys[0].Comment != usable {
+		t.Errorf("Expected the unusable default identity to be skipped, got %v", keys)
+	}
+
+	if _, err := newIdentityAgent([]string{unusable, usable}, false); err == nil {
+		t.Errorf("Expected an error for an unusable identity file given with -i")
+	}
+
+	// a background process receives the loaded keys instead of reading the files
+	keys, err := marshalLoadedKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(usable)
+	delete(loadedKeys, usable)
+	if err := receiveKeys(bytes.NewReader(keys)); err != nil {
+		t.Fatal(err)
+	}
+	received, err := loadPrivateKey(usable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh.FingerprintSHA256(signer.PublicKey()) != ssh.FingerprintSHA256(expected) {
+		t.Errorf("Expected the received key to be %s, got %s", ssh.FingerprintSHA256(expected), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+}
+
+func TestKeyFileArgs(t *testing.T) {
+	args := []string{"salio", "-i", "id_work", "-ca-key=ca", "-i", "id_home", "-ca-key=agent:SHA256:abc", "-u=admin"}
+	files := keyFileArgs(args)
+	if len(files) != 3 || files[0] != "id_work" || files[1] != "ca" || files[2] != "id_home" {
+		t.Errorf("Expected the -i and -ca-key files, got %v", files)
+	}
+}
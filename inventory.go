@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var invalidGroupChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// reservedInventoryKeys are the top level keys of the "--list" output that are not groups of hosts
+var reservedInventoryKeys = map[string]bool{"all": true, "ungrouped": true, "_meta": true}
+
+// inventoryScriptArgs turns the arguments Ansible runs an inventory script with, "--list" or "--host <host>", into
+// the inventory command so that salio can be used as the script. Global flags and -group-tags need a wrapper script:
+//
+//	#!/bin/sh
+//	exec salio -p prod -r ap-southeast-2 inventory -group-tags env,stack "$@"
+func inventoryScriptArgs(args []string) []string {
+	if len(args) > 0 && (args[0] == "--list" || args[0] == "--host") {
+		return append([]string{"inventory"}, args...)
+	}
+	return args
+}
+
+// inventoryGroup is a group in the Ansible dynamic inventory format
+type inventoryGroup struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	Children []string `json:"children,omitempty"`
+}
+
+// ansibleInventory builds the dynamic inventory from the instances. Hosts are named after their instance, or by ID
+// when several instances share the name, and grouped by cluster, role and the values of the given tags. Hosts behind
+// a bastion get a ProxyJump through it.
+type ansibleInventory struct {
+	groups   map[string]*inventoryGroup
+	hostvars map[string]map[string]interface{}
+}
+
+func newAnsibleInventory(instances []*instance, groupTags []string, bastionUser string, loginUser func(*instance) string) *ansibleInventory {
+	inv := &ansibleInventory{
+		groups:   make(map[string]*inventoryGroup),
+		hostvars: make(map[string]map[string]interface{}),
+	}
+
+	names := make(map[string]int)
+	for _, i := range instances {
+		names[i.Name]++
+	}
+
+	for _, i := range instances {
+		host := i.ID
+		if i.Name != "" && names[i.Name] == 1 {
+			host = i.Name
+		}
+
+		vars := map[string]interface{}{
+			"ec2_id":      i.ID,
+			"ec2_name":    i.Name,
+			"ec2_tags":    i.Tags,
+			"salio_role":  i.Role,
+			"salio_group": i.Cluster,
+		}
+		if i.IsNat {
+			if i.PublicIP == "" {
+				continue
+			}
+			vars["ansible_host"] = i.PublicIP
+			vars["ansible_user"] = bastionUser
+		} else {
+			bastion := firstBastion(i)
+			if bastion == nil || i.PrivateIP == "" {
+				continue
+			}
+			vars["ansible_host"] = i.PrivateIP
+			vars["ansible_user"] = loginUser(i)
+			vars["ansible_ssh_common_args"] = "-o ProxyJump=" + bastionUser + "@" + bastion.PublicIP
+		}
+		inv.hostvars[host] = vars
+
+		inv.add(i.Cluster, host)
+		if i.Role != "" {
+			inv.add("role_"+i.Role, host)
+		}
+		for _, tag := range groupTags {
+			if value, ok := i.Tags[tag]; ok && value != "" {
+				inv.add("tag_"+tag+"_"+value, host)
+			}
+		}
+	}
+	return inv
+}
+
+// add puts the host into the group, creating it if needed
+func (inv *ansibleInventory) add(group, host string) {
+	group = invalidGroupChars.ReplaceAllString(group, "_")
+	if group == "" {
+		return
+	}
+	if reservedInventoryKeys[group] {
+		// only a cluster can be named like this, the other groups have a prefix
+		group = "cluster_" + group
+	}
+	g, ok := inv.groups[group]
+	if !ok {
+		g = &inventoryGroup{}
+		inv.groups[group] = g
+	}
+	g.Hosts = append(g.Hosts, host)
+}
+
+// WriteList writes the output expected from "--list", including all hostvars in _meta
+func (inv *ansibleInventory) WriteList(w io.Writer) error {
+	out := make(map[string]interface{})
+	var children []string
+	for name, g := range inv.groups {
+		sort.Strings(g.Hosts)
+		out[name] = g
+		children = append(children, name)
+	}
+	sort.Strings(children)
+
+	var ungrouped []string
+	grouped := make(map[string]bool)
+	for _, g := range inv.groups {
+		for _, h := range g.Hosts {
+			grouped[h] = true
+		}
+	}
+	for host := range inv.hostvars {
+		if !grouped[host] {
+			ungrouped = append(ungrouped, host)
+		}
+	}
+	sort.Strings(ungrouped)
+
+	out["all"] = &inventoryGroup{Children: append(children, "ungrouped")}
+	out["ungrouped"] = &inventoryGroup{Hosts: ungrouped}
+	out["_meta"] = map[string]interface{}{"hostvars": inv.hostvars}
+	return writeJSON(w, out)
+}
+
+// WriteHost writes the output expected from "--host <host>", an empty object for unknown hosts
+func (inv *ansibleInventory) WriteHost(w io.Writer, host string) error {
+	vars, ok := inv.hostvars[host]
+	if !ok {
+		vars = map[string]interface{}{}
+	}
+	return writeJSON(w, vars)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// splitList splits a comma separated list and drops empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
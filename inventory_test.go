@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAnsibleInventory(t *testing.T) {
+	bastion := &instance{ID: "i-bastion", Name: "web.bastion", Cluster: "web", Role: "nat", IsNat: true, PublicIP: "1.2.3.4"}
+	app := &instance{
+		ID:        "i-app",
+		Name:      "web.app",
+		Cluster:   "web",
+		Role:      "app",
+		PrivateIP: "10.0.0.5",
+		Tags:      map[string]string{"env": "prod"},
+		Bastions:  []*instance{bastion},
+	}
+
+	inv := newAnsibleInventory([]*instance{bastion, app}, []string{"env"}, "ubuntu", func(i *instance) string { return "admin" })
+	var buf bytes.Buffer
+	if err := inv.WriteList(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var out struct {
+		Web     inventoryGroup `json:"web"`
+		RoleApp inventoryGroup `json:"role_app"`
+		EnvProd inventoryGroup `json:"tag_env_prod"`
+		Meta    struct {
+			Hostvars map[string]map[string]interface{} `json:"hostvars"`
+		} `json:"_meta"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out.Web.Hosts) != 2 {
+		t.Errorf("Expected 2 hosts in the web group, got %v", out.Web.Hosts)
+	}
+	if len(out.RoleApp.Hosts) != 1 || out.RoleApp.Hosts[0] != "web.app" {
+		t.Errorf("Expected web.app in the role_app group, got %v", out.RoleApp.Hosts)
+	}
+	if len(out.EnvProd.Hosts) != 1 {
+		t.Errorf("Expected 1 host in the tag_env_prod group, got %v", out.EnvProd.Hosts)
+	}
+
+	vars := out.Meta.Hostvars["web.app"]
+	if vars["ansible_host"] != "10.0.0.5" {
+		t.Errorf("Expected ansible_host 10.0.0.5, got %v", vars["ansible_host"])
+	}
+	if vars["ansible_ssh_common_args"] != "-o ProxyJump=ubuntu@1.2.3.4" {
+		t.Errorf("Expected a ProxyJump through the bastion, got %v", vars["ansible_ssh_common_args"])
+	}
+}
+
+func TestAnsibleInventoryNames(t *testing.T) {
+	bastion := &instance{ID: "i-bastion", Name: "all.bastion", Cluster: "all", IsNat: true, PublicIP: "1.2.3.4"}
+	first := &instance{ID: "i-1", Name: "all.app", Cluster: "all", PrivateIP: "10.0.0.5", Bastions: []*instance{bastion}}
+	second := &instance{ID: "i-2", Name: "all.app", Cluster: "-meta", PrivateIP: "10.0.0.6", Bastions: []*instance{bastion}}
+
+	inv := newAnsibleInventory([]*instance{bastion, first, second}, nil, "ubuntu", func(i *instance) string { return "admin" })
+	var buf bytes.Buffer
+	if err := inv.WriteList(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	var all, cluster, meta inventoryGroup
+	json.Unmarshal(out["all"], &all)
+	json.Unmarshal(out["cluster_all"], &cluster)
+	json.Unmarshal(out["cluster__meta"], &meta)
+	if len(all.Hosts) != 0 || len(all.Children) == 0 {
+		t.Errorf("Expected the all group to only have children, got %+v", all)
+	}
+	if !reflect.DeepEqual(cluster.Hosts, []string{"all.bastion", "i-1"}) {
+		t.Errorf("Expected the all cluster to be renamed and the shared name replaced by IDs, got %+v", cluster)
+	}
+	if !reflect.DeepEqual(meta.Hosts, []string{"i-2"}) {
+		t.Errorf("Expected the _meta cluster to be renamed, got %+v", meta)
+	}
+	if _, ok := inv.hostvars["all.app"]; ok {
+		t.Errorf("Expected a shared name not to be used as a host")
+	}
+}
+
+func TestInventoryScriptArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"--list"}, []string{"inventory", "--list"}},
+		{[]string{"--host", "web.app"}, []string{"inventory", "--host", "web.app"}},
+		{[]string{"-p", "prod", "inventory", "--list"}, []string{"-p", "prod", "inventory", "--list"}},
+		{[]string{"web", "app"}, []string{"web", "app"}},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		if got := inventoryScriptArgs(test.args); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Expected %v for %v, got %v", test.expected, test.args, got)
+		}
+	}
+}
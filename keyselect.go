@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// keyTag is the instance tag with the comma separated keys to offer to that host
+const keyTag = "salio:key"
+
+// hostKeySelectors returns the keys to offer to the host, the configured selectors take precedence over its tag
+func hostKeySelectors(i *instance, configured []string) []string {
+	if len(configured) > 0 {
+		return configured
+	}
+	return splitList(i.Tags[keyTag])
+}
+
+// selectSigners returns the signers matching any of the selectors, which are a SHA256 fingerprint, the comment of an
+// agent key, or a public key, certificate or private key file with a .pub file next to it. Without selectors all
+// signers are returned.
+func selectSigners(a agent.Agent, signers []ssh.Signer, selectors []string) ([]ssh.Signer, error) {
+	if len(selectors) == 0 {
+		return signers, nil
+	}
+
+	comments := make(map[string]string)
+	if keys, err := a.List(); err == nil {
+		for _, k := range keys {
+			comments[string(k.Blob)] = k.Comment
+		}
+	}
+
+	var selected []ssh.Signer
+	for _, sel := range selectors {
+		fileKeys := selectorKeys(sel)
+		found := false
+		for _, s := range signers {
+			pub := s.PublicKey()
+			plain := pub
+			if cert, ok := pub.(*ssh.Certificate); ok {
+				plain = cert.Key
+			}
+			match := sel == ssh.FingerprintSHA256(pub) || sel == ssh.FingerprintSHA256(plain) || sel == comments[string(pub.Marshal())]
+			for _, k := range fileKeys {
+				match = match || bytes.Equal(k.Marshal(), pub.Marshal()) || bytes.Equal(k.Marshal(), plain.Marshal())
+			}
+			if !match {
+				continue
+			}
+			found = true
+			if !containsSigner(selected, s) {
+				selected = append(selected, s)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no key matching %s", sel)
+		}
+	}
+	return selected, nil
+}
+
+// selectorKeys reads the public keys if the selector names a key file
+func selectorKeys(sel string) []ssh.PublicKey {
+	if strings.HasPrefix(sel, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			sel = filepath.Join(home, sel[2:])
+		}
+	}
+	for _, file := range []string{sel + ".pub", sel} {
+		if keys, err := loadPublicKeys(file); err == nil {
+			return keys
+		}
+	}
+	return nil
+}
+
+func containsSigner(signers []ssh.Signer, s ssh.Signer) bool {
+	for _, c := range signers {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
+
+// lastKeys remembers which key last logged in to a hop, so that it is offered first next time. Servers disconnect
+// after MaxAuthTries failed keys, which is quickly reached with many keys in the agent.
+type lastKeys struct {
+	File string
+
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+func defaultLastKeysPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "salio", "last_keys.json")
+}
+
+func newLastKeys(file string) *lastKeys {
+	l := &lastKeys{File: file, keys: make(map[string]string)}
+	if data, err := ioutil.ReadFile(file); err == nil {
+		json.Unmarshal(data, &l.keys)
+	}
+	return l
+}
+
+// hopKey identifies a hop by the cluster of the host, so that replaced bastions and instances reuse the key
+func hopKey(i *instance, hop string) string {
+	if i.Cluster == "" {
+		return i.ID + "/" + hop
+	}
+	return i.Cluster + "/" + hop
+}
+
+// Order moves the last successful key for the hop to the front and wraps the signers to record which one is used
+func (l *lastKeys) Order(hop string, signers []ssh.Signer) []ssh.Signer {
+	l.mu.Lock()
+	last := l.keys[hop]
+	l.mu.Unlock()
+
+	ordered := make([]ssh.Signer, 0, len(signers))
+	for _, s := range signers {
+		rs := &recordingSigner{Signer: s, record: func(s ssh.Signer) { l.record(hop, s) }}
+		if ssh.FingerprintSHA256(s.PublicKey()) == last {
+			ordered = append([]ssh.Signer{rs}, ordered...)
+		} else {
+			ordered = append(ordered, rs)
+		}
+	}
+	return ordered
+}
+
+func (l *lastKeys) record(hop string, s ssh.Signer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fp := ssh.FingerprintSHA256(s.PublicKey())
+	if l.keys[hop] == fp {
+		return
+	}
+	l.keys[hop] = fp
+	if l.File == "" {
+		return
+	}
+	data, err := json.MarshalIndent(l.keys, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(l.File), 0700)
+	ioutil.WriteFile(l.File, data, 0600)
+}
+
+// recordingSigner reports when it signs. Clients only sign with a key after the server accepted it, so the last key
+// that signed is the one that logged in.
+type recordingSigner struct {
+	ssh.Signer
+	record func(ssh.Signer)
+}
+
+func (s *recordingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	sig, err := s.Signer.Sign(rand, data)
+	if err == nil {
+		s.record(s.Signer)
+	}
+	return sig, err
+}
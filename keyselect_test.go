@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSelectSigners(t *testing.T) {
+	keyring := agent.NewKeyring()
+	for _, comment := range []string{"work", "personal", "ci"} {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: comment}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signers, err := keyring.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := keyring.List()
+	comment := make(map[string]string)
+	for _, k := range keys {
+		comment[string(k.Blob)] = k.Comment
+	}
+
+	all, err := selectSigners(keyring, signers, nil)
+	if err != nil || len(all) != 3 {
+		t.Errorf("Expected all signers without selectors, got %d %v", len(all), err)
+	}
+
+	ci := signers[0]
+	for _, s := range signers {
+		if comment[string(s.PublicKey().Marshal())] == "ci" {
+			ci = s
+		}
+	}
+	selected, err := selectSigners(keyring, signers, []string{"personal", ssh.FingerprintSHA256(ci.PublicKey())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || comment[string(selected[0].PublicKey().Marshal())] != "personal" || selected[1] != ci {
+		t.Errorf("Expected the personal and ci keys in order, got %d keys", len(selected))
+	}
+	if _, err := selectSigners(keyring, signers, []string{"missing"}); err == nil {
+		t.Errorf("Expected an error for a selector without a key")
+	}
+
+	last := newLastKeys("")
+	ordered := last.Order("web/bastion", signers)
+	if _, err := ordered[2].Sign(rand.Reader, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	ordered = last.Order("web/bastion", signers)
+	if ordered[0].PublicKey() != signers[2].PublicKey() {
+		t.Errorf("Expected the last used key to be offered first")
+	}
+}
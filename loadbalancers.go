@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+// fetchLoadBalancers returns an endpoint for every listener of the internal application and network load
+// balancers. Load balancers with more than one listener get the port appended to their name.
+func fetchLoadBalancers(config *aws.Config) ([]*endpoint, error) {
+	s := session.Must(session.NewSession(config))
+	svc := elbv2.New(s, &aws.Config{})
+
+	var balancers []*elbv2.LoadBalancer
+	err := svc.DescribeLoadBalancersPages(&elbv2.DescribeLoadBalancersInput{}, func(page *elbv2.DescribeLoadBalancersOutput, last bool) bool {
+		for _, lb := range page.LoadBalancers {
+			if aws.StringValue(lb.Scheme) == elbv2.LoadBalancerSchemeEnumInternal {
+				balancers = append(balancers, lb)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []*endpoint
+	for _, lb := range balancers {
+		var listeners []*elbv2.Listener
+		err := svc.DescribeListenersPages(&elbv2.DescribeListenersInput{LoadBalancerArn: lb.LoadBalancerArn}, func(page *elbv2.DescribeListenersOutput, last bool) bool {
+			listeners = append(listeners, page.Listeners...)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, listenerEndpoints(lb, listeners)...)
+	}
+	return endpoints, nil
+}
+
+// listenerEndpoints returns an endpoint for every listener of the load balancer, named after the load balancer with
+// the port appended if there is more than one
+func listenerEndpoints(lb *elbv2.LoadBalancer, listeners []*elbv2.Listener) []*endpoint {
+	status := ""
+	if lb.State != nil {
+		status = aws.StringValue(lb.State.Code)
+	}
+	var endpoints []*endpoint
+	for _, l := range listeners {
+		id := aws.StringValue(lb.LoadBalancerName)
+		if len(listeners) > 1 {
+			id += ":" + strconv.FormatInt(aws.Int64Value(l.Port), 10)
+		}
+		endpoints = append(endpoints, &endpoint{
+			Type:   loadBalancerType(aws.StringValue(lb.Type)),
+			ID:     id,
+			Engine: strings.ToLower(aws.StringValue(l.Protocol)),
+			Host:   aws.StringValue(lb.DNSName),
+			Port:   int(aws.Int64Value(l.Port)),
+			VpcID:  aws.StringValue(lb.VpcId),
+			Status: status,
+		})
+	}
+	return endpoints
+}
+
+func loadBalancerType(t string) string {
+	switch t {
+	case elbv2.LoadBalancerTypeEnumApplication:
+		return endpointALB
+	case elbv2.LoadBalancerTypeEnumNetwork:
+		return endpointNLB
+	}
+	return t
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+func TestListenerEndpoints(t *testing.T) {
+	lb := &elbv2.LoadBalancer{
+		LoadBalancerName: aws.String("internal-api"),
+		DNSName:          aws.String("internal-api.elb.amazonaws.com"),
+		Type:             aws.String(elbv2.LoadBalancerTypeEnumApplication),
+		VpcId:            aws.String("vpc-prod"),
+		State:            &elbv2.LoadBalancerState{Code: aws.String("active")},
+	}
+	http := &elbv2.Listener{Port: aws.Int64(80), Protocol: aws.String("HTTP")}
+	https := &elbv2.Listener{Port: aws.Int64(443), Protocol: aws.String("HTTPS")}
+
+	tests := []struct {
+		lbType    string
+		listeners []*elbv2.Listener
+		expected  []endpoint
+	}{
+		{elbv2.LoadBalancerTypeEnumApplication, []*elbv2.Listener{https}, []endpoint{
+			{Type: endpointALB, ID: "internal-api", Engine: "https", Host: "internal-api.elb.amazonaws.com", Port: 443, VpcID: "vpc-prod", Status: "active"},
+		}},
+		{elbv2.LoadBalancerTypeEnumApplication, []*elbv2.Listener{http, https}, []endpoint{
+			{Type: endpointALB, ID: "internal-api:80", Engine: "http", Host: "internal-api.elb.amazonaws.com", Port: 80, VpcID: "vpc-prod", Status: "active"},
+			{Type: endpointALB, ID: "internal-api:443", Engine: "https", Host: "internal-api.elb.amazonaws.com", Port: 443, VpcID: "vpc-prod", Status: "active"},
+		}},
+		{elbv2.LoadBalancerTypeEnumNetwork, []*elbv2.Listener{https}, []endpoint{
+			{Type: endpointNLB, ID: "internal-api", Engine: "https", Host: "internal-api.elb.amazonaws.com", Port: 443, VpcID: "vpc-prod", Status: "active"},
+		}},
+		{"gateway", []*elbv2.Listener{https}, []endpoint{
+			{Type: "gateway", ID: "internal-api", Engine: "https", Host: "internal-api.elb.amazonaws.com", Port: 443, VpcID: "vpc-prod", Status: "active"},
+		}},
+	}
+	for _, test := range tests {
+		lb.Type = aws.String(test.lbType)
+		endpoints := listenerEndpoints(lb, test.listeners)
+		if len(endpoints) != len(test.expected) {
+			t.Errorf("Expected %d endpoints, got %+v", len(test.expected), endpoints)
+			continue
+		}
+		for n, e := range test.expected {
+			if *endpoints[n] != e {
+				t.Errorf("Expected %+v, got %+v", e, *endpoints[n])
+			}
+		}
+	}
+}
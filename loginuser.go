@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// userTag is the instance tag that sets the login user for that instance
+const userTag = "salio:user"
+
+// amiUserMapping maps AMIs to the login user of their images. Owner is an account ID or owner alias and Pattern is
+// matched against the image name or ID, both are optional.
+type amiUserMapping struct {
+	Owner   string
+	Pattern string
+	User    string
+}
+
+// defaultAMIUsers are the login users of the common public images
+var defaultAMIUsers = []amiUserMapping{
+	{Owner: "099720109477", User: "ubuntu"},
+	{Pattern: "ubuntu/*", User: "ubuntu"},
+	{Pattern: "ubuntu-*", User: "ubuntu"},
+	{Owner: "136693071363", User: "admin"},
+	{Owner: "379101102735", User: "admin"},
+	{Pattern: "debian-*", User: "admin"},
+	{Owner: "amazon", Pattern: "amzn*", User: "ec2-user"},
+	{Owner: "amazon", Pattern: "al20*", User: "ec2-user"},
+	{Owner: "309956199498", User: "ec2-user"},
+	{Owner: "125523088429", User: "centos"},
+	{Pattern: "centos*", User: "centos"},
+	{Owner: "595879546273", User: "core"},
+	{Owner: "075585003325", User: "core"},
+	{Pattern: "coreos-*", User: "core"},
+	{Pattern: "flatcar-*", User: "core"},
+}
+
+// parseAMIUserMapping parses "pattern=user", where the pattern is matched against the image name or ID
+func parseAMIUserMapping(s string) (amiUserMapping, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return amiUserMapping{}, fmt.Errorf("invalid AMI user mapping %q, expected pattern=user", s)
+	}
+	if _, err := path.Match(parts[0], ""); err != nil {
+		return amiUserMapping{}, fmt.Errorf("invalid AMI user mapping %q: %s", s, err)
+	}
+	return amiUserMapping{Pattern: parts[0], User: parts[1]}, nil
+}
+
+func (m amiUserMapping) matches(image *ec2.Image) bool {
+	if m.Owner != "" && m.Owner != aws.StringValue(image.OwnerId) && m.Owner != aws.StringValue(image.ImageOwnerAlias) {
+		return false
+	}
+	if m.Pattern == "" {
+		return true
+	}
+	pattern := strings.ToLower(m.Pattern)
+	for _, s := range []string{aws.StringValue(image.Name), aws.StringValue(image.ImageId)} {
+		if ok, _ := path.Match(pattern, strings.ToLower(s)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loginUsers works out which users to try when logging in to an instance. A salio:user tag or a configured mapping
+// for the AMI decide the user, otherwise the user that worked last time for the AMI and the user that the AMI name
+// and owner suggest are tried before the Ubuntu and Debian defaults. AMIs are only described when needed, or all at
+// once by Describe when the users of many instances are needed.
+type loginUsers struct {
+	Mappings []amiUserMapping
+	File     string
+
+	describe func(imageIDs []string) ([]*ec2.Image, error)
+	mu       sync.Mutex
+	images   map[string]*ec2.Image
+	worked   map[string]string
+	tagged   map[string]bool
+}
+
+func defaultLoginUsersPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "salio", "ami_users.json")
+}
+
+func newLoginUsers(config *aws.Config, mappings []amiUserMapping, file string) *loginUsers {
+	svc := ec2.New(session.Must(session.NewSession(config)), &aws.Config{})
+	l := &loginUsers{
+		Mappings: mappings,
+		File:     file,
+		describe: func(imageIDs []string) ([]*ec2.Image, error) {
+			resp, err := svc.DescribeImages(&ec2.DescribeImagesInput{ImageIds: aws.StringSlice(imageIDs)})
+			if err != nil {
+				return nil, err
+			}
+			return resp.Images, nil
+		},
+		images: make(map[string]*ec2.Image),
+		worked: make(map[string]string),
+	}
+	if data, err := ioutil.ReadFile(file); err == nil {
+		json.Unmarshal(data, &l.worked)
+	}
+	return l
+}
+
+// Users returns the users to try for the instance in order
+func (l *loginUsers) Users(i *instance) []string {
+	if user := i.Tags[userTag]; user != "" {
+		l.mu.Lock()
+		if l.tagged == nil {
+			l.tagged = make(map[string]bool)
+		}
+		l.tagged[user] = true
+		l.mu.Unlock()
+		return []string{user}
+	}
+	if i.ImageID == "" {
+		return []string{UbuntuUser, DebianUser}
+	}
+
+	image := l.image(i.ImageID)
+	for _, m := range l.Mappings {
+		if m.matches(image) {
+			return []string{m.User}
+		}
+	}
+
+	var users []string
+	l.mu.Lock()
+	if user, ok := l.worked[i.ImageID]; ok {
+		users = append(users, user)
+	}
+	l.mu.Unlock()
+	for _, m := range defaultAMIUsers {
+		if m.matches(image) {
+			users = append(users, m.User)
+			break
+		}
+	}
+	users = append(users, UbuntuUser, DebianUser)
+	return uniqueUsers(users)
+}
+
+// Principals returns all the users that Users may return, so that a session certificate is valid for them. Users
+// from salio:user tags are included once Users has seen the instance.
+func (l *loginUsers) Principals() []string {
+	users := []string{UbuntuUser, DebianUser}
+	for _, m := range defaultAMIUsers {
+		users = append(users, m.User)
+	}
+	for _, m := range l.Mappings {
+		users = append(users, m.User)
+	}
+
+	var seen []string
+	l.mu.Lock()
+	for _, user := range l.worked {
+		seen = append(seen, user)
+	}
+	for user := range l.tagged {
+		seen = append(seen, user)
+	}
+	l.mu.Unlock()
+	sort.Strings(seen)
+	return uniqueUsers(append(users, seen...))
+}
+
+// uniqueUsers drops repeated users, keeping the order
+func uniqueUsers(users []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, u := range users {
+		if !seen[u] {
+			seen[u] = true
+			unique = append(unique, u)
+		}
+	}
+	return unique
+}
+
+// image returns the description of the AMI, or an image with just the ID if it can't be described, e.g. because
+// it was deregistered or is private to another account
+func (l *loginUsers) image(imageID string) *ec2.Image {
+	l.mu.Lock()
+	image, ok := l.images[imageID]
+	l.mu.Unlock()
+	if ok {
+		return image
+	}
+	l.describeImages([]string{imageID})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.images[imageID]
+}
+
+// Describe describes the AMIs of the instances that haven't been described yet with a single request
+func (l *loginUsers) Describe(instances []*instance) {
+	var imageIDs []string
+	seen := make(map[string]bool)
+	l.mu.Lock()
+	for _, i := range instances {
+		if i.ImageID == "" || i.Tags[userTag] != "" || seen[i.ImageID] {
+			continue
+		}
+		seen[i.ImageID] = true
+		if _, ok := l.images[i.ImageID]; !ok {
+			imageIDs = append(imageIDs, i.ImageID)
+		}
+	}
+	l.mu.Unlock()
+	sort.Strings(imageIDs)
+	if len(imageIDs) > 0 {
+		l.describeImages(imageIDs)
+	}
+}
+
+// describeImages describes and caches the AMIs. A request for several AMIs fails as a whole if one of them is
+// malformed or unavailable, so they are then described one by one to keep the others.
+func (l *loginUsers) describeImages(imageIDs []string) {
+	// the lock isn't held while describing, so an image may be described twice by concurrent connections
+	images, err := l.describe(imageIDs)
+	if err != nil && len(imageIDs) > 1 {
+		for _, id := range imageIDs {
+			l.describeImages([]string{id})
+		}
+		return
+	}
+	described := make(map[string]*ec2.Image)
+	for _, image := range images {
+		described[aws.StringValue(image.ImageId)] = image
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range imageIDs {
+		image, ok := described[id]
+		if !ok {
+			if err == nil {
+				err = errors.New("not found")
+			}
+			fmt.Printf("[!] can't describe %s: %s\n", id, err)
+			image = &ec2.Image{ImageId: aws.String(id)}
+		}
+		l.images[id] = image
+	}
+}
+
+// Worked remembers the user that logged in to the instance for its AMI
+func (l *loginUsers) Worked(i *instance, user string) {
+	if i.ImageID == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.worked[i.ImageID] == user {
+		return
+	}
+	l.worked[i.ImageID] = user
+	if l.File == "" {
+		return
+	}
+	data, err := json.MarshalIndent(l.worked, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(l.File), 0700)
+	ioutil.WriteFile(l.File, data, 0600)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestLoginUsers(t *testing.T) {
+	images := map[string]*ec2.Image{
+		"ami-amzn":   {ImageId: aws.String("ami-amzn"), Name: aws.String("al2023-ami-2023.5.20240624.0-kernel-6.1-x86_64"), ImageOwnerAlias: aws.String("amazon")},
+		"ami-debian": {ImageId: aws.String("ami-debian"), Name: aws.String("debian-12-amd64-20240717-1811"), OwnerId: aws.String("136693071363")},
+		"ami-custom": {ImageId: aws.String("ami-custom"), Name: aws.String("my-base-2024-07-01"), OwnerId: aws.String("123456789012")},
+	}
+	mapping, err := parseAMIUserMapping("my-base-*=deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &loginUsers{
+		Mappings: []amiUserMapping{mapping},
+		describe: func(imageIDs []string) ([]*ec2.Image, error) {
+			var found []*ec2.Image
+			for _, id := range imageIDs {
+				if image, ok := images[id]; ok {
+					found = append(found, image)
+				}
+			}
+			return found, nil
+		},
+		images: make(map[string]*ec2.Image),
+		worked: make(map[string]string),
+	}
+
+	for _, tc := range []struct {
+		instance *instance
+		expected []string
+	}{
+		{&instance{ImageID: "ami-amzn"}, []string{"ec2-user", UbuntuUser, DebianUser}},
+		{&instance{ImageID: "ami-debian"}, []string{DebianUser, UbuntuUser}},
+		{&instance{ImageID: "ami-custom"}, []string{"deploy"}},
+		{&instance{ImageID: "ami-gone"}, []string{UbuntuUser, DebianUser}},
+		{&instance{ImageID: "ami-amzn", Tags: map[string]string{userTag: "root"}}, []string{"root"}},
+	} {
+		if users := l.Users(tc.instance); !reflect.DeepEqual(users, tc.expected) {
+			t.Errorf("Expected %v for %s, got %v", tc.expected, tc.instance.ImageID, users)
+		}
+	}
+
+	l.Worked(&instance{ImageID: "ami-gone"}, "centos")
+	if users := l.Users(&instance{ImageID: "ami-gone"}); users[0] != "centos" {
+		t.Errorf("Expected the user that worked to be tried first, got %v", users)
+	}
+
+	if _, err := parseAMIUserMapping("no-user"); err == nil {
+		t.Errorf("Expected an error for a mapping without a user")
+	}
+}
+
+func TestLoginUsersDescribe(t *testing.T) {
+	var requests [][]string
+	l := &loginUsers{
+		describe: func(imageIDs []string) ([]*ec2.Image, error) {
+			requests = append(requests, imageIDs)
+			for _, id := range imageIDs {
+				if id == "ami-malformed" {
+					return nil, errors.New("InvalidAMIID.Malformed")
+				}
+			}
+			var images []*ec2.Image
+			for _, id := range imageIDs {
+				if id != "ami-gone" {
+					images = append(images, &ec2.Image{ImageId: aws.String(id), OwnerId: aws.String("099720109477")})
+				}
+			}
+			return images, nil
+		},
+		images: make(map[string]*ec2.Image),
+		worked: make(map[string]string),
+	}
+	instances := []*instance{
+		{ImageID: "ami-b"}, {ImageID: "ami-a"}, {ImageID: "ami-b"}, {ImageID: "ami-gone"},
+		{ImageID: "ami-tagged", Tags: map[string]string{userTag: "root"}}, {},
+	}
+	l.Describe(instances)
+	if !reflect.DeepEqual(requests, [][]string{{"ami-a", "ami-b", "ami-gone"}}) {
+		t.Errorf("Expected the images to be described in one request, got %v", requests)
+	}
+	for _, i := range instances[:4] {
+		l.Users(i)
+	}
+	l.Describe(instances)
+	if len(requests) != 1 {
+		t.Errorf("Expected the described images to be cached, got %v", requests)
+	}
+	if users := l.Users(instances[0]); users[0] != "ubuntu" {
+		t.Errorf("Expected the user of the described image, got %v", users)
+	}
+
+	// a request that fails as a whole is retried image by image
+	requests = nil
+	l.Describe([]*instance{{ImageID: "ami-c"}, {ImageID: "ami-malformed"}})
+	if len(requests) != 3 || l.images["ami-c"].OwnerId == nil {
+		t.Errorf("Expected the images to be described one by one after the request failed, got %v", requests)
+	}
+}
+
+func TestLoginUsersDescribeUnlocked(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	l := &loginUsers{
+		describe: func(imageIDs []string) ([]*ec2.Image, error) {
+			close(started)
+			<-release
+			return []*ec2.Image{{ImageId: aws.String(imageIDs[0])}}, nil
+		},
+		images: make(map[string]*ec2.Image),
+		worked: make(map[string]string),
+	}
+	described := make(chan []string)
+	go func() {
+		described <- l.Users(&instance{ImageID: "ami-slow"})
+	}()
+	<-started
+
+	worked := make(chan struct{})
+	go func() {
+		l.Worked(&instance{ImageID: "ami-other"}, "core")
+		close(worked)
+	}()
+	select {
+	case <-worked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the users of other instances to be usable while an image is described")
+	}
+	close(release)
+	if users := <-described; !reflect.DeepEqual(users, []string{UbuntuUser, DebianUser}) {
+		t.Errorf("Expected the default users, got %v", users)
+	}
+}
+
+func TestSessionPrincipals(t *testing.T) {
+	mapping, err := parseAMIUserMapping("my-base-*=deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &loginUsers{Mappings: []amiUserMapping{mapping}, images: make(map[string]*ec2.Image), worked: make(map[string]string)}
+
+	contains := func(users []string, user string) bool {
+		for _, u := range users {
+			if u == user {
+				return true
+			}
+		}
+		return false
+	}
+	principals := sessionPrincipals("bastion", "", l)
+	for _, user := range []string{"bastion", UbuntuUser, DebianUser, "ec2-user", "core", "deploy"} {
+		if !contains(principals, user) {
+			t.Errorf("Expected the principals to include %s, got %v", user, principals)
+		}
+	}
+	if contains(principals, "root") {
+		t.Errorf("Expected a tagged user only once an instance has the tag, got %v", principals)
+	}
+	l.Users(&instance{Tags: map[string]string{userTag: "root"}})
+	if principals := sessionPrincipals("bastion", "", l); !contains(principals, "root") {
+		t.Errorf("Expected the tagged user to be included, got %v", principals)
+	}
+
+	if principals := sessionPrincipals("ubuntu", "app", l); !reflect.DeepEqual(principals, []string{"ubuntu", "app"}) {
+		t.Errorf("Expected only the bastion and instance users, got %v", principals)
+	}
+}
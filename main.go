@@ -2,12 +2,16 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"sort"
@@ -16,6 +20,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/dgryski/go-fuzzstr"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 const (
@@ -40,6 +45,8 @@ type instance struct {
 	Cluster    string
 	Bastions   []*instance
 	LaunchTime *time.Time
+	ImageID    string
+	VpcID      string
 }
 
 type instancePair struct {
@@ -49,6 +56,43 @@ type instancePair struct {
 
 /**
  * usage: salio -p playpen -r ap-southeast-2 cluster stack env
+ *        salio -N -L 8080:localhost:80 -L 5432:db.internal:5432 cluster stack env
+ *        salio -N -R 9000:localhost:9000 cluster stack env
+ *        salio -N -L 2375:/var/run/docker.sock cluster stack env
+ *        salio -N -D 1080 cluster stack env
+ *        salio -N -http-proxy 3128 -proxy-allow 10.0.0.0/16,*.internal cluster stack env
+ *        salio cp -r ./config cluster.stack.env:/tmp/config
+ *        salio push -parallel 10 ./app.conf cluster.stack.env:/etc/app/
+ *        salio pull cluster.stack.env:/var/log/syslog ./logs
+ *        ssh -o ProxyCommand="salio proxy %h %p" admin@i-0123456789abcdef0
+ *        salio ssh-config -o ~/.ssh/salio_config cluster
+ *        salio inventory -group-tags env,stack --list
+ *        salio --list
+ *        salio -host-key-check strict -known-hosts ~/.ssh/known_hosts cluster stack env
+ *        salio -console-host-keys -host-key-check strict cluster stack env
+ *        salio -host-ca ~/.ssh/host_ca.pub -cert ~/.ssh/id_ed25519-cert.pub cluster stack env
+ *        salio -ca-key ~/.ssh/user_ca -cert-validity 2m cluster stack env
+ *        salio -i ~/.ssh/deploy_key cluster stack env
+ *        salio -bastion-key ~/.ssh/bastion.pub -instance-key SHA256:abc... cluster stack env
+ *        salio -ami-user "my-base-*=deploy" cluster stack env
+ *        salio -forward-agent confirm -forward-agent-key ~/.ssh/github.pub cluster stack env
+ *        salio -mux cluster stack env
+ *        salio daemon list
+ *        salio -detach -L 5432:db.internal:5432 cluster stack env
+ *        salio tunnels list
+ *        salio tunnels restart all
+ *        salio daemon kill cluster.stack.env
+ *        salio db -port 15432 orders prod
+ *        salio -- db prod
+ *        salio cache sessions
+ *        salio lb -port 8443 internal api
+ *        salio endpoint orders
+ *        salio @pg-prod
+ *        salio @pg-prod -instance-user root
+ *        salio @prod db orders
+ *        salio profiles
+ *        salio -serial 25% -health-check "curl -sf localhost" run cluster stack env -- sudo service app restart
+ *        salio -serial 2 -health-check "curl -sf localhost" -health-timeout 10m run cluster stack env -- sudo reboot
  */
 func main() {
 
@@ -58,12 +102,76 @@ func main() {
 	bastionUser := flag.String("bastion-user", defaultBastionUserName, "SSH user for bastions")
 	instanceUser := flag.String("instance-user", "", "SSH user for instances")
 
-	flag.Parse()
+	serial := flag.String("serial", "", "batch size for run, either a number of instances or a percentage (e.g. 2 or 25%)")
+	pause := flag.Duration("pause", 0, "pause between batches for run")
+	healthCheck := flag.String("health-check", "", "command that must succeed on every instance in a batch before the next batch starts")
+	healthTimeout := flag.Duration("health-timeout", 5*time.Minute, "how long to retry the health check for run")
+	healthInterval := flag.Duration("health-interval", 5*time.Second, "wait between health check attempts for run")
+	maxFailures := flag.Int("max-failures", 1, "abort run after this many failed instances")
+	stateFile := flag.String("state", "", "state file used to resume an interrupted run")
+	var localForwards stringList
+	flag.Var(&localForwards, "L", "forward a local port or socket to a host or socket reachable from the instance, [bind_address:]port:host:hostport or port:/remote/socket (can be repeated)")
+	var remoteForwards stringList
+	flag.Var(&remoteForwards, "R", "forward a port on the instance back to a host reachable from this machine, [bind_address:]port:host:hostport (can be repeated)")
+	dynamicForward := flag.String("D", "", "start a SOCKS5 proxy on [bind_address:]port that connects via the instance")
+	httpProxyAddr := flag.String("http-proxy", "", "start a HTTP proxy on [bind_address:]port that connects via the instance")
+	var proxyAllow stringList
+	flag.Var(&proxyAllow, "proxy-allow", "comma separated CIDRs and host names (*.example.com) the HTTP proxy may connect to (can be repeated)")
+	noShell := flag.Bool("N", false, "only forward ports, do not open a shell")
+	detached := flag.Bool("detach", false, "run the forwards as a tunnel in the background that reconnects when the connection is lost, see salio tunnels")
+	knownHosts := flag.String("known-hosts", defaultKnownHostsPath(), "known_hosts file used to verify bastion and instance host keys")
+	hostKeyCheck := flag.String("host-key-check", hostKeyAsk, "how to treat unknown host keys: strict rejects them, ask trusts them on first use after confirmation, off disables host key checking")
+	var identityFiles, hostCAs, certFiles, bastionKeys, instanceKeys, forwardKeys, amiUsers stringList
+	flag.Var(&amiUsers, "ami-user", "login user for AMIs whose name or ID matches the pattern, pattern=user, overrides the user detected from the AMI (can be repeated)")
+	forwardAgent := flag.String("forward-agent", "", "forward the agent to instances: yes, confirm to ask before each signing request, or no, overrides the salio:forward-agent tag")
+	forwardClusters := flag.String("forward-agent-clusters", "", "comma separated clusters to forward the agent to")
+	flag.Var(&forwardKeys, "forward-agent-key", "only expose this key to instances through the forwarded agent, a SHA256 fingerprint, agent key comment or key file (can be repeated)")
+	flag.Var(&bastionKeys, "bastion-key", "only offer this key to bastions, a SHA256 fingerprint, agent key comment or key file, overrides the salio:key tag (can be repeated)")
+	flag.Var(&instanceKeys, "instance-key", "only offer this key to instances, a SHA256 fingerprint, agent key comment or key file, overrides the salio:key tag (can be repeated)")
+	flag.Var(&identityFiles, "i", "identity file to authenticate with instead of the ssh-agent, defaults to ~/.ssh/id_* when there is no ssh-agent (can be repeated)")
+	flag.Var(&hostCAs, "host-ca", "file with the public key of a SSH CA whose host certificates are trusted (can be repeated)")
+	flag.Var(&certFiles, "cert", "user certificate to present, the private key is taken from the ssh-agent or the file without the -cert.pub suffix (can be repeated)")
+	caKey := flag.String("ca-key", "", "sign a short-lived certificate for a per-session key with this CA private key file, or agent:<fingerprint or comment> for a CA key in the ssh-agent")
+	certValidity := flag.Duration("cert-validity", 5*time.Minute, "how long session certificates signed with -ca-key are valid")
+	certPrincipals := flag.String("cert-principals", "", "comma separated principals of session certificates, defaults to the bastion and instance users")
+	consoleKeys := flag.Bool("console-host-keys", false, "trust the host keys printed to the EC2 console output of an instance before consulting known_hosts")
+	mux := flag.Bool("mux", false, "open connections through the background daemon, starting it if it isn't running, so that later commands reuse them")
+	muxIdle := flag.Duration("mux-idle", 10*time.Minute, "close connections held by the daemon after they have been unused this long, the daemon exits once it has none")
+
+	configFile := flag.String("config", defaultConfigPath(), "config file with the profiles used as salio @name")
+
+	parsed := inventoryScriptArgs(os.Args[1:])
+	flag.CommandLine.Parse(parsed)
 	if len(os.Args) < 2 {
 		printUsageAndQuit(1)
 	}
 
-	searchTerm := strings.Join(flag.Args(), ".")
+	args := flag.Args()
+	search := searchOnly(parsed, args)
+	if len(args) > 0 && strings.HasPrefix(args[0], "@") {
+		// flags may follow the profile name, they override the profile
+		name := args[0][1:]
+		handleError(flag.CommandLine.Parse(args[1:]))
+		search = searchOnly(args[1:], flag.Args())
+		c, err := loadConfig(*configFile)
+		handleError(err)
+		profile, err := c.Profile(name)
+		handleError(err)
+		terms, err := applyProfile(flag.CommandLine, name, profile)
+		handleError(err)
+		// the search terms of a profile would end up in front of a command or be mixed with other terms
+		if len(terms) > 0 && flag.NArg() > 0 {
+			handleError(fmt.Errorf("profile %s has search terms, unexpected arguments: %s", name, strings.Join(flag.Args(), " ")))
+		}
+		if len(terms) > 0 {
+			search = true
+		}
+		args = append(terms, flag.Args()...)
+	}
+	command := ""
+	if len(args) > 0 && !search {
+		command = args[0]
+	}
 
 	if err := os.Setenv("AWS_PROFILE", *profile); err != nil {
 		fmt.Fprintf(os.Stderr, "Error setting ENV var 'AWS_PROFILE': %s", err)
@@ -80,6 +188,303 @@ func main() {
 		config.Region = aws.String("ap-southeast-2")
 	}
 
+	if os.Getenv(keysEnv) != "" {
+		// started in the background by salio, which hands over the keys it has loaded
+		handleError(receiveKeys(os.Stdin))
+		os.Unsetenv(keysEnv)
+	}
+
+	hostKeys, err := newHostKeyVerifier(*knownHosts, *hostKeyCheck)
+	handleError(err)
+	var mappings []amiUserMapping
+	for _, m := range amiUsers {
+		mapping, err := parseAMIUserMapping(m)
+		handleError(err)
+		mappings = append(mappings, mapping)
+	}
+	if *consoleKeys {
+		hostKeys.Console = newConsoleHostKeys(config, defaultConsoleKeysDir())
+	}
+	for _, file := range hostCAs {
+		keys, err := loadPublicKeys(file)
+		handleError(err)
+		hostKeys.Authorities = append(hostKeys.Authorities, keys...)
+	}
+	tunnel := &tunnelConfig{
+		BastionUser:  *bastionUser,
+		InstanceUser: *instanceUser,
+		HostKeys:     hostKeys,
+		CertFiles:    certFiles,
+		BastionKeys:  bastionKeys,
+		InstanceKeys: instanceKeys,
+		LastKeys:     newLastKeys(defaultLastKeysPath()),
+		LoginUsers:   newLoginUsers(config, mappings, defaultLoginUsersPath()),
+		Forwarding: &agentForwarding{
+			Mode:     *forwardAgent,
+			Clusters: splitList(*forwardClusters),
+			Keys:     forwardKeys,
+		},
+	}
+	if *mux {
+		tunnel.Mux, err = defaultMuxSocket()
+		handleError(err)
+	}
+	handleError(validForwardAgentMode(*forwardAgent))
+	tunnel.Identities = func() (agent.Agent, error) {
+		var a agent.Agent
+		var err error
+		defaultIdentities := len(identityFiles) == 0 && os.Getenv("SSH_AUTH_SOCK") == ""
+		if defaultIdentities {
+			identityFiles = defaultIdentityFiles()
+		}
+		if len(identityFiles) > 0 {
+			if a, err = newIdentityAgent(identityFiles, defaultIdentities); err != nil {
+				return nil, err
+			}
+		}
+		if *caKey != "" {
+			ca, err := loadCASigner(*caKey)
+			if err != nil {
+				return nil, err
+			}
+			principals := func() []string {
+				return sessionPrincipals(*bastionUser, *instanceUser, tunnel.LoginUsers)
+			}
+			if fixed := splitList(*certPrincipals); len(fixed) > 0 {
+				principals = func() []string { return fixed }
+			}
+			return newSessionAgent(ca, principals, *certValidity)
+		}
+		return a, nil
+	}
+
+	forwards, err := newForwardSet(localForwards, remoteForwards, *dynamicForward, *httpProxyAddr, proxyAllow)
+	handleError(err)
+	if *detached && forwards.Empty() {
+		handleError(errors.New("-detach needs forwards, use -L, -R, -D or -http-proxy"))
+	}
+
+	switch command {
+	case "run":
+		searchTerms, remoteCommand := splitCommand(args[1:])
+		if len(searchTerms) == 0 || remoteCommand == "" {
+			printUsageAndQuit(1)
+		}
+		candidates := discover(config, strings.Join(searchTerms, "."))
+		r := &rollingRun{
+			Command:        remoteCommand,
+			BatchSize:      *serial,
+			Pause:          *pause,
+			HealthCheck:    *healthCheck,
+			HealthTimeout:  *healthTimeout,
+			HealthInterval: *healthInterval,
+			MaxFailures:    *maxFailures,
+			StateFile:      *stateFile,
+			connect: func(c *instancePair) (*sshForwardingClient, error) {
+				return connect(c, tunnel)
+			},
+		}
+		handleError(r.Run(candidates))
+		return
+	case "cp":
+		cp := flag.NewFlagSet("cp", flag.ExitOnError)
+		recursive := cp.Bool("r", false, "recursively copy directories")
+		cp.Parse(args[1:])
+		if cp.NArg() != 2 {
+			printUsageAndQuit(1)
+		}
+		srcTarget, srcPath, srcRemote := splitRemotePath(cp.Arg(0))
+		dstTarget, dstPath, dstRemote := splitRemotePath(cp.Arg(1))
+		if srcRemote == dstRemote {
+			handleError(errors.New("exactly one of source and destination must be remote, e.g. cluster.stack.env:/tmp/file"))
+		}
+		target := srcTarget
+		if dstRemote {
+			target = dstTarget
+		}
+
+		candidate := pickCandidate(discover(config, target), *autoJump)
+		sshClient, err := connect(candidate, tunnel)
+		handleError(err)
+		transfer, err := newFileTransfer(sshClient, true)
+		handleError(err)
+		if dstRemote {
+			err = transfer.Upload(srcPath, dstPath, *recursive)
+		} else {
+			err = transfer.Download(srcPath, dstPath, *recursive)
+		}
+		transfer.Close()
+		handleError(err)
+		return
+	case "proxy":
+		if len(args) < 2 || len(args) > 3 {
+			printUsageAndQuit(1)
+		}
+		port := "22"
+		if len(args) == 3 {
+			port = args[2]
+		}
+		stdout := reserveStdout()
+		instances, err := fetchInstances(config)
+		handleError(err)
+		pair, err := resolveProxyTarget(args[1], instances)
+		handleError(err)
+		handleError(proxyStdio(tunnel, pair, port, os.Stdin, stdout))
+		return
+	case "daemon":
+		if len(args) < 2 {
+			printUsageAndQuit(1)
+		}
+		handleError(daemonCommand(tunnel, args[1], args[2:], *muxIdle))
+		return
+	case "profiles":
+		c, err := loadConfig(*configFile)
+		handleError(err)
+		printProfiles(os.Stdout, c)
+		return
+	case "tunnels":
+		if len(args) < 2 {
+			printUsageAndQuit(1)
+		}
+		handleError(tunnelsCommand(tunnel, config, forwards, args[1], args[2:]))
+		return
+	case "db", "cache", "lb", "endpoint":
+		endpoints := flag.NewFlagSet(command, flag.ExitOnError)
+		port := endpoints.Int("port", 0, "local port to forward, defaults to the port of the endpoint")
+		dbUser := endpoints.String("user", "", "database user for the connection string, defaults to the master user")
+		dbName := endpoints.String("name", "", "database name for the connection string, defaults to the initial database")
+		endpoints.Parse(args[1:])
+		all, err := fetchEndpoints(config, command)
+		handleError(err)
+		found := findEndpoints(strings.Join(endpoints.Args(), ""), all)
+		if len(found) == 0 {
+			fmt.Println("No endpoints found")
+			return
+		}
+		e := pickEndpoint(found, *autoJump)
+		if *dbUser == "" {
+			*dbUser = e.User
+		}
+		if *dbName == "" {
+			*dbName = e.Database
+		}
+		instances, err := fetchInstances(config)
+		handleError(err)
+		handleError(forwardEndpoint(tunnel, instances, e, *port, func(host string, port int) string {
+			return endpointURL(e, *dbUser, *dbName, host, port)
+		}))
+		return
+	case "ssh-config":
+		sshConfig := flag.NewFlagSet(command, flag.ExitOnError)
+		output := sshConfig.String("o", defaultSSHConfigPath(), "file to write the managed Host blocks to")
+		yes := sshConfig.Bool("y", false, "write changes without asking for confirmation")
+		sshConfig.Parse(args[1:])
+
+		instances, err := fetchInstances(config)
+		handleError(err)
+		if sshConfig.NArg() > 0 {
+			instances = filterInstances(instances, findInstanceNames(strings.Join(sshConfig.Args(), "."), instances))
+		}
+		if *instanceUser == "" {
+			tunnel.LoginUsers.Describe(instances)
+		}
+		block := sshConfigBlock(instances, *bastionUser, tunnel.loginUser)
+		handleError(writeSSHConfig(*output, block, !*yes))
+		return
+	case "inventory":
+		inventory := flag.NewFlagSet(command, flag.ExitOnError)
+		list := inventory.Bool("list", false, "print the whole inventory")
+		host := inventory.String("host", "", "print the variables of a single host")
+		groupTags := inventory.String("group-tags", "", "comma separated tag names to group hosts by")
+		inventory.Parse(args[1:])
+		if !*list && *host == "" {
+			printUsageAndQuit(1)
+		}
+
+		stdout := reserveStdout()
+		instances, err := fetchInstances(config)
+		handleError(err)
+		if *instanceUser == "" {
+			tunnel.LoginUsers.Describe(instances)
+		}
+		inv := newAnsibleInventory(instances, splitList(*groupTags), *bastionUser, tunnel.loginUser)
+		if *host != "" {
+			handleError(inv.WriteHost(stdout, *host))
+		} else {
+			handleError(inv.WriteList(stdout))
+		}
+		return
+	case "push", "pull":
+		bulk := flag.NewFlagSet(command, flag.ExitOnError)
+		recursive := bulk.Bool("r", false, "recursively copy directories")
+		parallel := bulk.Int("parallel", 5, "number of instances to copy to or from at the same time")
+		bulk.Parse(args[1:])
+		if bulk.NArg() != 2 {
+			printUsageAndQuit(1)
+		}
+		b := &bulkTransfer{
+			Recursive: *recursive,
+			Parallel:  *parallel,
+			connect: func(c *instancePair) (*sshForwardingClient, error) {
+				return connect(c, tunnel)
+			},
+		}
+		var results []*bulkResult
+		if command == "push" {
+			target, remotePath, remote := splitRemotePath(bulk.Arg(1))
+			if !remote {
+				handleError(errors.New("the destination must be remote, e.g. cluster.stack.env:/tmp/file"))
+			}
+			results = b.Push(discover(config, target), bulk.Arg(0), remotePath)
+		} else {
+			target, remotePath, remote := splitRemotePath(bulk.Arg(0))
+			if !remote {
+				handleError(errors.New("the source must be remote, e.g. cluster.stack.env:/var/log/syslog"))
+			}
+			results = b.Pull(discover(config, target), remotePath, bulk.Arg(1))
+		}
+		handleError(printBulkSummary(os.Stdout, results))
+		return
+	}
+
+	candidate := pickCandidate(discover(config, strings.Join(args, ".")), *autoJump)
+
+	sshClient, err := connect(candidate, tunnel)
+	handleError(err)
+	fmt.Printf("[+] connected to %s\n\n", candidate.Instance.PrivateIP)
+
+	if *detached {
+		// the first connection is made here so that host keys and passphrases can be confirmed on the terminal
+		sshClient.Close()
+		dir, err := defaultTunnelsDir()
+		handleError(err)
+		handleError(startDetachedTunnel(dir, candidate, forwards))
+		return
+	}
+
+	listeners, err := forwards.Start(sshClient)
+	handleError(err)
+
+	if *noShell {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupt
+			closeAll(listeners)
+			sshClient.Close()
+		}()
+		sshClient.Wait()
+		return
+	}
+
+	err = Shell(sshClient)
+	closeAll(listeners)
+	handleError(err)
+}
+
+// discover fetches all instances and returns the ones matching the search term sorted by name and launch time. It
+// exits if no instances could be found.
+func discover(config *aws.Config, searchTerm string) []*instancePair {
 	instances, err := fetchInstances(config)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error fetching ec2 instances: %s\n", err.Error())
@@ -96,31 +501,89 @@ func main() {
 		fmt.Println("No instances found")
 		os.Exit(0)
 	}
+	return candidates
+}
 
-	candidate := candidates[0]
-	if !*autoJump || len(candidates) > 1 {
-		candidate = chooseCandidate(candidates)
+// connect opens a SSH connection to the candidate via its bastion, or through the daemon if one is configured
+func connect(candidate *instancePair, cfg *tunnelConfig) (*sshForwardingClient, error) {
+	if cfg.Mux != "" {
+		if cfg.Forwarding == nil || cfg.Forwarding.modeFor(candidate.Instance) != forwardAgentConfirm {
+			return connectMux(cfg, candidate, cfg.InstanceUser)
+		}
+		// the daemon can't ask on this terminal before each signing request
+		fmt.Println("[+] agent forwarding needs confirmation on this terminal, connecting without the daemon")
 	}
+	sshClient, _, err := connectAs(candidate, cfg, cfg.InstanceUser)
+	return sshClient, err
+}
 
-	var sshClient *sshForwardingClient
-	if *instanceUser != "" {
-		sshClient, err = newTunnelledSSHClient(*bastionUser, *instanceUser, candidate.Bastion.PublicIP, candidate.Instance.PrivateIP)
-		if err != nil {
-			handleError(err)
-		}
-	} else {
-		sshClient, err = newTunnelledSSHClient(*bastionUser, UbuntuUser, candidate.Bastion.PublicIP, candidate.Instance.PrivateIP)
-		if err != nil {
+// connectAs opens a SSH connection to the candidate via its bastion and returns it with the user it logged in as. If
+// no instance user is given it tries the users suggested for the AMI of the instance, falling back to the Ubuntu and
+// Debian users.
+func connectAs(candidate *instancePair, cfg *tunnelConfig, instanceUser string) (*sshForwardingClient, string, error) {
+	if instanceUser != "" {
+		sshClient, err := newTunnelledSSHClient(cfg, candidate, instanceUser)
+		return sshClient, instanceUser, err
+	}
+	users := []string{UbuntuUser, DebianUser}
+	if cfg.LoginUsers != nil {
+		users = cfg.LoginUsers.Users(candidate.Instance)
+	}
+
+	var err error
+	for n, user := range users {
+		if n > 0 {
 			fmt.Printf("[+] connection failed: %s\n", err)
-			sshClient, err = newTunnelledSSHClient(*bastionUser, DebianUser, candidate.Bastion.PublicIP, candidate.Instance.PrivateIP)
-			if err != nil {
-				handleError(err)
+		}
+		var sshClient *sshForwardingClient
+		sshClient, err = newTunnelledSSHClient(cfg, candidate, user)
+		if err == nil {
+			if cfg.LoginUsers != nil {
+				cfg.LoginUsers.Worked(candidate.Instance, user)
 			}
+			return sshClient, user, nil
+		}
+		// only the instance refusing the user is worth trying the next user for, errors reaching the bastion or the
+		// instance, or with their host keys, would only repeat
+		var refused *loginError
+		if !errors.As(err, &refused) {
+			return nil, "", err
 		}
 	}
-	fmt.Printf("[+] connected to %s\n\n", candidate.Instance.PrivateIP)
-	err = Shell(sshClient)
-	handleError(err)
+	return nil, "", err
+}
+
+// sessionPrincipals are the users a session certificate has to be valid for when no principals are given
+func sessionPrincipals(bastionUser, instanceUser string, l *loginUsers) []string {
+	principals := []string{bastionUser}
+	users := []string{instanceUser}
+	if instanceUser == "" {
+		users = l.Principals()
+	}
+	for _, u := range users {
+		if u != bastionUser {
+			principals = append(principals, u)
+		}
+	}
+	return principals
+}
+
+// splitCommand splits arguments on the first "--" into search terms and a remote command
+func splitCommand(args []string) ([]string, string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], strings.Join(args[i+1:], " ")
+		}
+	}
+	return args, ""
+}
+
+// pickCandidate returns the only candidate if auto jump is enabled, otherwise the user is asked to choose one
+func pickCandidate(candidates []*instancePair, autoJump bool) *instancePair {
+	if autoJump && len(candidates) == 1 {
+		return candidates[0]
+	}
+	return chooseCandidate(candidates)
 }
 
 // Prompts the user to choose which target to SSH into
@@ -196,30 +659,48 @@ func (p candidateSort) Less(i, j int) bool {
 }
 func (p candidateSort) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
+// filterInstances returns the instances with one of the given names
+func filterInstances(instances []*instance, names []string) []*instance {
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var filtered []*instance
+	for _, i := range instances {
+		if wanted[i.Name] {
+			filtered = append(filtered, i)
+		}
+	}
+	return filtered
+}
+
 // findInstanceNames takes the users typed target name and finds real instance names from that
 func findInstanceNames(targetName string, instances []*instance) []string {
-
 	var instanceNames []string
 	for _, i := range instances {
 		instanceNames = append(instanceNames, i.Name)
 	}
+	return fuzzyNames(targetName, instanceNames)
+}
 
-	fuzzIndex := fuzzstr.NewIndex(instanceNames)
-	postings := fuzzIndex.Query(targetName)
+// fuzzyNames returns the distinct names that contain the characters of the search term in order
+func fuzzyNames(term string, names []string) []string {
+	fuzzIndex := fuzzstr.NewIndex(names)
+	postings := fuzzIndex.Query(term)
 
 	result := make(map[string]bool)
 	for i := 0; i < len(postings); i++ {
-		name := instanceNames[postings[i].Doc]
+		name := names[postings[i].Doc]
 		result[name] = true
 	}
 
 	// convert back into a slice
-	var names []string
+	var matches []string
 	for name := range result {
-		names = append(names, name)
+		matches = append(matches, name)
 	}
 
-	return names
+	return matches
 }
 
 func padToLen(s string, padStr string, overallLen int) string {
@@ -294,6 +775,8 @@ func newInstance(inst *ec2.Instance) *instance {
 	}
 
 	i.LaunchTime = inst.LaunchTime
+	i.ImageID = aws.StringValue(inst.ImageId)
+	i.VpcID = aws.StringValue(inst.VpcId)
 
 	for k := range inst.Tags {
 		i.Tags[*inst.Tags[k].Key] = *inst.Tags[k].Value
@@ -314,9 +797,32 @@ func newInstance(inst *ec2.Instance) *instance {
 	return i
 }
 
+// reserveStdout hands out the real stdout and points os.Stdout at stderr, so that progress messages don't corrupt
+// output that is consumed by other programs
+func reserveStdout() io.Writer {
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	return stdout
+}
+
+// searchOnly reports whether the arguments left after parsing the flags follow "--", which makes them search terms
+// even if the first one is a command word, e.g. salio -- db prod
+func searchOnly(parsed, rest []string) bool {
+	i := len(parsed) - len(rest)
+	return i > 0 && parsed[i-1] == "--"
+}
+
+// subcommands are the words that run a command when they come first instead of searching for instances
+var subcommands = []string{
+	"run", "cp", "push", "pull", "proxy", "daemon", "tunnels", "profiles",
+	"db", "cache", "lb", "endpoint", "ssh-config", "inventory",
+}
+
 func printUsageAndQuit(exitCode int) {
 	fmt.Printf("salio - ssh proxy (%s)\n", version)
 	flag.Usage()
+	fmt.Fprintf(flag.CommandLine.Output(), "\nCommands: %s\n", strings.Join(subcommands, ", "))
+	fmt.Fprintln(flag.CommandLine.Output(), "To search for instances with one of these words first, put -- in front of the search terms, e.g. salio -- db prod")
 	os.Exit(exitCode)
 }
 
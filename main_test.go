@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"testing"
 )
 
@@ -43,3 +44,28 @@ func TestFindCandidates(t *testing.T) {
 		t.Errorf("Expected candidate instance name to be %s, got %s", bastion.Name, paths[0].Bastion.Name)
 	}
 }
+
+func TestSearchOnly(t *testing.T) {
+	tests := []struct {
+		args   []string
+		search bool
+	}{
+		{[]string{"db", "prod"}, false},
+		{[]string{"--", "db", "prod"}, true},
+		{[]string{"-auto-jump", "--", "db", "prod"}, true},
+		{[]string{"-p", "prod", "db", "--", "prod"}, false},
+		{[]string{"run", "web", "--", "uptime"}, false},
+		{[]string{"--"}, true},
+	}
+	for _, test := range tests {
+		flags := flag.NewFlagSet("salio", flag.ContinueOnError)
+		flags.Bool("auto-jump", false, "")
+		flags.String("p", "", "")
+		if err := flags.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		if search := searchOnly(test.args, flags.Args()); search != test.search {
+			t.Errorf("Expected %q to search only to be %t, got %t", test.args, test.search, search)
+		}
+	}
+}
@@ -0,0 +1,878 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Requests understood by the daemon in addition to the ones it passes on to the instance
+const (
+	muxConnectRequest = "connect@salio"
+	muxListRequest    = "list@salio"
+	muxKillRequest    = "kill@salio"
+	muxStopRequest    = "stop@salio"
+)
+
+// runtimeDir is where the daemon socket and detached tunnels are kept. Without a cache directory it is a directory of
+// its own in the shared temporary directory, which must not have been created by another user.
+func runtimeDir() (string, error) {
+	dir := ""
+	if cache, err := os.UserCacheDir(); err == nil {
+		dir = filepath.Join(cache, "salio")
+	} else {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("salio-%d", os.Getuid()))
+	}
+	if err := privateDir(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// defaultMuxSocket is where the daemon listens
+func defaultMuxSocket() (string, error) {
+	dir, err := runtimeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mux.sock"), nil
+}
+
+// muxAuthFlags are the flags that change how connections are authenticated and host keys are verified. The daemon
+// only serves clients that have the same settings as the one that started it.
+var muxAuthFlags = []string{
+	"bastion-user", "known-hosts", "host-key-check", "host-ca", "console-host-keys", "ami-user", "i", "cert", "ca-key",
+	"cert-validity", "cert-principals", "bastion-key", "instance-key", "forward-agent", "forward-agent-clusters",
+	"forward-agent-key",
+}
+
+// muxSettings describes the authentication settings of this invocation for comparison with those of the daemon
+func muxSettings() string {
+	settings := []string{
+		"AWS_PROFILE=" + os.Getenv("AWS_PROFILE"),
+		"AWS_REGION=" + os.Getenv("AWS_REGION"),
+		"SSH_AUTH_SOCK=" + os.Getenv("SSH_AUTH_SOCK"),
+	}
+	for _, arg := range passthroughFlags() {
+		for _, name := range muxAuthFlags {
+			if arg == "-"+name || strings.HasPrefix(arg, "-"+name+"=") {
+				settings = append(settings, arg)
+			}
+		}
+	}
+	return strings.Join(settings, " ")
+}
+
+// muxConnectMsg asks the daemon for a connection to the instance
+type muxConnectMsg struct {
+	Bastion  *instance
+	Instance *instance
+	User     string
+	Settings string
+}
+
+// muxConnectFailure is why the daemon couldn't connect. If it was an unknown host key, the client asks whether to
+// trust it and tries again.
+type muxConnectFailure struct {
+	Error       string
+	UnknownHost string
+	Remote      string
+	Key         []byte
+}
+
+// muxConnectReply describes the connection the daemon attached the client to
+type muxConnectReply struct {
+	User         string
+	ForwardAgent bool
+}
+
+// muxStatus is a connection held by the daemon, as returned by the list request
+type muxStatus struct {
+	ID       string
+	Name     string
+	User     string
+	Bastion  string
+	Clients  int
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// muxDaemon keeps authenticated connections to instances open and lets later salio commands use them. It is a SSH
+// server on a unix socket: a client asks for an instance with a connect request, after which its channels and global
+// requests are passed on to the connection to the instance. Connections without clients are closed once they have
+// been idle for the timeout, and the daemon exits when it has had nothing to do for as long.
+type muxDaemon struct {
+	Socket   string
+	Idle     time.Duration
+	Settings string
+
+	connect func(pair *instancePair, user string) (*sshForwardingClient, string, error)
+	// closeBastion closes the connection to a bastion once no connection held by the daemon goes through it
+	closeBastion func(bastionID string)
+	config       *ssh.ServerConfig
+	listener     net.Listener
+
+	mu        sync.Mutex
+	upstreams map[string]*muxUpstream
+	lastUsed  time.Time
+}
+
+// muxUpstream is a connection to an instance shared by the clients attached to it
+type muxUpstream struct {
+	key     string
+	pair    *instancePair
+	client  *sshForwardingClient
+	user    string
+	created time.Time
+
+	mu       sync.Mutex
+	clients  map[*ssh.ServerConn]bool
+	lastUsed time.Time
+}
+
+func newMuxDaemon(socket string, idle time.Duration, connect func(*instancePair, string) (*sshForwardingClient, string, error)) (*muxDaemon, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	// access is controlled by the permissions of the socket
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	return &muxDaemon{
+		Socket:    socket,
+		Idle:      idle,
+		connect:   connect,
+		config:    config,
+		upstreams: make(map[string]*muxUpstream),
+		lastUsed:  time.Now(),
+	}, nil
+}
+
+// Listen creates the socket, replacing a stale one left behind by a daemon that didn't exit cleanly
+func (d *muxDaemon) Listen() error {
+	if err := os.MkdirAll(filepath.Dir(d.Socket), 0700); err != nil {
+		return err
+	}
+	if conn, err := net.Dial("unix", d.Socket); err == nil {
+		conn.Close()
+		return fmt.Errorf("a daemon is already listening on %s", d.Socket)
+	}
+	os.Remove(d.Socket)
+
+	l, err := net.Listen("unix", d.Socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(d.Socket, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	d.listener = l
+	return nil
+}
+
+// Serve accepts clients until the daemon is stopped or has been idle for the timeout
+func (d *muxDaemon) Serve() error {
+	go d.expire()
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			d.closeAll()
+			return nil
+		}
+		go d.handle(conn)
+	}
+}
+
+// Stop closes the socket and all connections
+func (d *muxDaemon) Stop() {
+	d.listener.Close()
+	os.Remove(d.Socket)
+}
+
+func (d *muxDaemon) expire() {
+	interval := d.Idle / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		d.mu.Lock()
+		for key, u := range d.upstreams {
+			u.mu.Lock()
+			idle := len(u.clients) == 0 && time.Since(u.lastUsed) > d.Idle
+			u.mu.Unlock()
+			if idle {
+				fmt.Printf("[+] closing idle connection to %s (%s)\n", u.pair.Instance.Name, u.pair.Instance.ID)
+				d.remove(key, u)
+			}
+		}
+		done := len(d.upstreams) == 0 && time.Since(d.lastUsed) > d.Idle
+		d.mu.Unlock()
+		if done {
+			fmt.Println("[+] idle, exiting")
+			d.Stop()
+			return
+		}
+	}
+}
+
+func (d *muxDaemon) closeAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, u := range d.upstreams {
+		d.remove(key, u)
+	}
+}
+
+// remove closes the connection and the connection to its bastion if it was the last one through it. The caller
+// holds d.mu.
+func (d *muxDaemon) remove(key string, u *muxUpstream) {
+	u.client.Close()
+	delete(d.upstreams, key)
+	for _, other := range d.upstreams {
+		if other.pair.Bastion.ID == u.pair.Bastion.ID {
+			return
+		}
+	}
+	if d.closeBastion != nil {
+		d.closeBastion(u.pair.Bastion.ID)
+	}
+}
+
+func (d *muxDaemon) touch() {
+	d.mu.Lock()
+	d.lastUsed = time.Now()
+	d.mu.Unlock()
+}
+
+// handle serves a client until it disconnects
+func (d *muxDaemon) handle(conn net.Conn) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, d.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	d.touch()
+
+	var upstream *muxUpstream
+	var listeners []net.Listener
+	defer func() {
+		closeListeners(listeners)
+		if upstream != nil {
+			upstream.detach(serverConn)
+		}
+		d.touch()
+	}()
+
+	attached := make(chan *muxUpstream, 1)
+	go func() {
+		// channels can only be opened once the client is attached to an instance
+		u, ok := <-attached
+		for newChannel := range chans {
+			if !ok {
+				newChannel.Reject(ssh.Prohibited, "not connected to an instance")
+				continue
+			}
+			go proxyChannel(newChannel, u.client)
+		}
+	}()
+	defer close(attached)
+
+	for req := range reqs {
+		switch req.Type {
+		case muxConnectRequest:
+			if upstream != nil {
+				req.Reply(false, []byte("already connected"))
+				continue
+			}
+			var msg muxConnectMsg
+			if err := json.Unmarshal(req.Payload, &msg); err != nil || msg.Instance == nil || msg.Bastion == nil {
+				req.Reply(false, muxFailure(errors.New("invalid connect request")))
+				continue
+			}
+			if msg.Settings != d.Settings {
+				req.Reply(false, muxFailure(fmt.Errorf("the daemon was started with other settings (%s), stop it with: salio daemon stop", d.Settings)))
+				continue
+			}
+			u, err := d.upstream(&instancePair{Bastion: msg.Bastion, Instance: msg.Instance}, msg.User)
+			if err != nil {
+				req.Reply(false, muxFailure(err))
+				continue
+			}
+			u.attach(serverConn)
+			upstream = u
+			attached <- u
+			reply, _ := json.Marshal(&muxConnectReply{User: u.user, ForwardAgent: u.client.agentForwarding})
+			req.Reply(true, reply)
+		case muxListRequest:
+			reply, _ := json.Marshal(d.list())
+			req.Reply(true, reply)
+		case muxKillRequest:
+			n := d.kill(string(req.Payload))
+			req.Reply(true, []byte(strconv.Itoa(n)))
+		case muxStopRequest:
+			req.Reply(true, nil)
+			d.Stop()
+		case "tcpip-forward":
+			if upstream == nil {
+				req.Reply(false, nil)
+				continue
+			}
+			l, reply, err := remoteListen(upstream.client, serverConn, req.Payload)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			listeners = append(listeners, l)
+			req.Reply(true, reply)
+		case "cancel-tcpip-forward":
+			listeners = cancelListen(listeners, req)
+		default:
+			if upstream == nil {
+				req.Reply(false, nil)
+				continue
+			}
+			ok, reply, _ := upstream.client.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				req.Reply(ok, reply)
+			}
+		}
+	}
+}
+
+// upstream returns the open connection to the instance for the user, connecting if there is none
+func (d *muxDaemon) upstream(pair *instancePair, user string) (*muxUpstream, error) {
+	key := pair.Instance.ID + "/" + user
+	d.mu.Lock()
+	u, ok := d.upstreams[key]
+	d.mu.Unlock()
+	if ok {
+		return u, nil
+	}
+
+	client, loggedIn, err := d.connect(pair, user)
+	if err != nil {
+		return nil, err
+	}
+	u = &muxUpstream{
+		key:      key,
+		pair:     pair,
+		client:   client,
+		user:     loggedIn,
+		created:  time.Now(),
+		clients:  make(map[*ssh.ServerConn]bool),
+		lastUsed: time.Now(),
+	}
+	fmt.Printf("[+] connected to %s (%s) as %s\n", pair.Instance.Name, pair.Instance.ID, loggedIn)
+
+	d.mu.Lock()
+	if existing, ok := d.upstreams[key]; ok {
+		// another client connected at the same time
+		d.mu.Unlock()
+		client.Close()
+		return existing, nil
+	}
+	d.upstreams[key] = u
+	d.mu.Unlock()
+
+	go func() {
+		client.Wait()
+		d.mu.Lock()
+		if d.upstreams[key] == u {
+			delete(d.upstreams, key)
+		}
+		d.mu.Unlock()
+		u.mu.Lock()
+		for c := range u.clients {
+			c.Close()
+		}
+		u.mu.Unlock()
+	}()
+	return u, nil
+}
+
+func (u *muxUpstream) attach(c *ssh.ServerConn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.clients[c] = true
+	u.lastUsed = time.Now()
+}
+
+func (u *muxUpstream) detach(c *ssh.ServerConn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.clients, c)
+	u.lastUsed = time.Now()
+}
+
+func (d *muxDaemon) list() []*muxStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var list []*muxStatus
+	for _, u := range d.upstreams {
+		u.mu.Lock()
+		list = append(list, &muxStatus{
+			ID:       u.pair.Instance.ID,
+			Name:     u.pair.Instance.Name,
+			User:     u.user,
+			Bastion:  u.pair.Bastion.PublicIP,
+			Clients:  len(u.clients),
+			Created:  u.created,
+			LastUsed: u.lastUsed,
+		})
+		u.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// kill closes the connections to the instances with the ID or name, or all of them, and returns how many were closed
+func (d *muxDaemon) kill(target string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for key, u := range d.upstreams {
+		if target == "all" || target == u.pair.Instance.ID || target == u.pair.Instance.Name {
+			d.remove(key, u)
+			n++
+		}
+	}
+	return n
+}
+
+// muxFailure is the reply to a connect request that failed
+func muxFailure(err error) []byte {
+	failure := &muxConnectFailure{Error: err.Error()}
+	var unknown *unknownHostKeyError
+	if errors.As(err, &unknown) {
+		failure.UnknownHost = unknown.Hostname
+		failure.Key = unknown.Key.Marshal()
+		if unknown.Remote != nil {
+			failure.Remote = unknown.Remote.String()
+		}
+	}
+	reply, _ := json.Marshal(failure)
+	return reply
+}
+
+// proxyChannel passes a channel opened by a client on to the instance, along with its requests in both directions
+func proxyChannel(newChannel ssh.NewChannel, upstream ssh.Conn) {
+	up, upReqs, err := upstream.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	down, downReqs, err := newChannel.Accept()
+	if err != nil {
+		up.Close()
+		return
+	}
+
+	// the client's side is only closed once the data and requests of the instance's side have been passed on, so that
+	// e.g. the output and exit status arrive before the close
+	go func() {
+		proxyRequests(downReqs, up)
+		up.Close()
+	}()
+	go func() {
+		io.Copy(up, down)
+		up.CloseWrite()
+	}()
+
+	requests := make(chan struct{})
+	go func() {
+		proxyRequests(upReqs, down)
+		close(requests)
+	}()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(down.Stderr(), up.Stderr())
+	}()
+	io.Copy(down, up)
+	wg.Wait()
+	down.CloseWrite()
+	<-requests
+	down.Close()
+}
+
+func proxyRequests(in <-chan *ssh.Request, out ssh.Channel) {
+	for req := range in {
+		ok, err := out.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, nil)
+		}
+	}
+}
+
+// remoteListen listens on the instance for a client's remote forward and opens a forwarded-tcpip channel to the
+// client for each connection
+func remoteListen(client *sshForwardingClient, serverConn *ssh.ServerConn, payload []byte) (net.Listener, []byte, error) {
+	var msg struct {
+		Addr string
+		Port uint32
+	}
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return nil, nil, err
+	}
+	l, err := client.Listen("tcp", net.JoinHostPort(msg.Addr, strconv.Itoa(int(msg.Port))))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	var reply []byte
+	if msg.Port == 0 {
+		reply = ssh.Marshal(struct{ Port uint32 }{port})
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				origin, _ := conn.RemoteAddr().(*net.TCPAddr)
+				forwarded := struct {
+					Addr       string
+					Port       uint32
+					OriginAddr string
+					OriginPort uint32
+				}{Addr: msg.Addr, Port: port}
+				if origin != nil {
+					forwarded.OriginAddr = origin.IP.String()
+					forwarded.OriginPort = uint32(origin.Port)
+				}
+				ch, reqs, err := serverConn.OpenChannel("forwarded-tcpip", ssh.Marshal(&forwarded))
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				pipe(ch, conn)
+			}()
+		}
+	}()
+	return l, reply, nil
+}
+
+// cancelListen stops the remote forward named in the cancel request
+func cancelListen(listeners []net.Listener, req *ssh.Request) []net.Listener {
+	var msg struct {
+		Addr string
+		Port uint32
+	}
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		req.Reply(false, nil)
+		return listeners
+	}
+	for n, l := range listeners {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok && uint32(addr.Port) == msg.Port {
+			l.Close()
+			req.Reply(true, nil)
+			return append(listeners[:n], listeners[n+1:]...)
+		}
+	}
+	req.Reply(false, nil)
+	return listeners
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// dialMux connects to the daemon
+func dialMux(socket string) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            "salio",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, socket, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// connectMux returns a connection to the instance through the daemon, starting the daemon if it isn't running. Host
+// keys the daemon doesn't know are confirmed here, where there is a terminal to ask on.
+func connectMux(cfg *tunnelConfig, pair *instancePair, user string) (*sshForwardingClient, error) {
+	socket := cfg.Mux
+	client, err := dialMux(socket)
+	if err != nil {
+		if err := startMuxDaemon(); err != nil {
+			return nil, err
+		}
+		for wait := 0; wait < 50 && err != nil; wait++ {
+			time.Sleep(100 * time.Millisecond)
+			client, err = dialMux(socket)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("the daemon did not start, see %s: %s", muxLogFile(socket), err)
+		}
+	}
+
+	msg, _ := json.Marshal(&muxConnectMsg{
+		Bastion:  stripBastions(pair.Bastion),
+		Instance: stripBastions(pair.Instance),
+		User:     user,
+		Settings: muxSettings(),
+	})
+	var payload []byte
+	// the bastion and the instance may both have unknown host keys
+	for attempt := 0; ; attempt++ {
+		var ok bool
+		ok, payload, err = client.SendRequest(muxConnectRequest, true, msg)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if err := confirmMuxHostKey(cfg.HostKeys, payload, attempt); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	var reply muxConnectReply
+	if err := json.Unmarshal(payload, &reply); err != nil {
+		client.Close()
+		return nil, err
+	}
+	fmt.Printf("[+] using the connection to %s as %s held by the daemon\n", pair.Instance.Name, reply.User)
+	return &sshForwardingClient{reply.ForwardAgent, client, false}, nil
+}
+
+// confirmMuxHostKey checks a host key the daemon doesn't know against known_hosts, asking whether to trust it in ask
+// mode. It returns the reason the daemon couldn't connect if it wasn't an unknown host key.
+func confirmMuxHostKey(hostKeys *hostKeyVerifier, payload []byte, attempt int) error {
+	var failure muxConnectFailure
+	if err := json.Unmarshal(payload, &failure); err != nil {
+		return errors.New(string(payload))
+	}
+	if failure.UnknownHost == "" || hostKeys == nil || attempt > 1 {
+		return errors.New(failure.Error)
+	}
+	key, err := ssh.ParsePublicKey(failure.Key)
+	if err != nil {
+		return err
+	}
+	remote, err := net.ResolveTCPAddr("tcp", failure.Remote)
+	if err != nil {
+		return err
+	}
+	return hostKeys.Check(failure.UnknownHost, remote, key)
+}
+
+// stripBastions copies the instance without its bastions for sending to the daemon
+func stripBastions(i *instance) *instance {
+	c := *i
+	c.Bastions = nil
+	return &c
+}
+
+func muxLogFile(socket string) string {
+	return filepath.Join(filepath.Dir(socket), "daemon.log")
+}
+
+// startMuxDaemon runs "salio daemon run" in the background with the flags of this invocation, so that the daemon
+// authenticates the same way
+func startMuxDaemon() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	socket, err := defaultMuxSocket()
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(muxLogFile(socket), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, append(passthroughFlags("mux"), "daemon", "run")...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	detach(cmd)
+	if err := startWithKeys(cmd); err != nil {
+		return err
+	}
+	fmt.Printf("[+] started the daemon, pid %d\n", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// muxRequest sends a control request to the daemon
+func muxRequest(socket, request string, payload []byte) ([]byte, error) {
+	client, err := dialMux(socket)
+	if err != nil {
+		return nil, errors.New("the daemon is not running")
+	}
+	defer client.Close()
+	ok, reply, err := client.SendRequest(request, true, payload)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("the daemon refused %s", request)
+	}
+	return reply, nil
+}
+
+// printMuxList prints the connections held by the daemon
+func printMuxList(w io.Writer, list []*muxStatus) {
+	if len(list) == 0 {
+		fmt.Fprintln(w, "[+] no connections")
+		return
+	}
+	longestName := 0
+	for _, s := range list {
+		if len(s.Name) > longestName {
+			longestName = len(s.Name)
+		}
+	}
+	for _, s := range list {
+		idle := "active"
+		if s.Clients == 0 {
+			idle = "idle " + time.Since(s.LastUsed).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%-19s %s %-10s via %-15s %d client(s), up %s, %s\n", s.ID, padToLen(s.Name, " ", longestName), s.User, s.Bastion, s.Clients, time.Since(s.Created).Round(time.Second), idle)
+	}
+}
+
+// passthroughFlags returns the global flags that were set on the command line, except the skipped ones, so that they
+// can be given to a salio started in the background
+func passthroughFlags(skip ...string) []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		for _, s := range skip {
+			if f.Name == s {
+				return
+			}
+		}
+		if list, ok := f.Value.(*stringList); ok {
+			for _, v := range *list {
+				args = append(args, "-"+f.Name, v)
+			}
+			return
+		}
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	return args
+}
+
+// daemonCommand runs one of the daemon subcommands: run, start, list, kill <instance|all> or stop
+func daemonCommand(cfg *tunnelConfig, command string, args []string, idle time.Duration) error {
+	socket, err := defaultMuxSocket()
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "run":
+		d, err := newMuxDaemon(socket, idle, func(pair *instancePair, user string) (*sshForwardingClient, string, error) {
+			return connectAs(pair, cfg, user)
+		})
+		if err != nil {
+			return err
+		}
+		d.Settings = muxSettings()
+		d.closeBastion = cfg.closeBastion
+		if cfg.HostKeys != nil {
+			cfg.HostKeys.Deferred = true
+		}
+		if err := d.Listen(); err != nil {
+			return err
+		}
+		defer cfg.Close()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupt
+			d.Stop()
+		}()
+		fmt.Printf("[+] daemon listening on %s\n", socket)
+		return d.Serve()
+	case "start":
+		if client, err := dialMux(socket); err == nil {
+			client.Close()
+			fmt.Printf("[+] the daemon is already running on %s\n", socket)
+			return nil
+		}
+		// the daemon is handed the keys, so passphrases are asked for now
+		if err := cfg.loadIdentities(); err != nil {
+			return err
+		}
+		return startMuxDaemon()
+	case "list":
+		reply, err := muxRequest(socket, muxListRequest, nil)
+		if err != nil {
+			return err
+		}
+		var list []*muxStatus
+		if err := json.Unmarshal(reply, &list); err != nil {
+			return err
+		}
+		printMuxList(os.Stdout, list)
+		return nil
+	case "kill":
+		if len(args) != 1 {
+			return errors.New("usage: salio daemon kill <instance id or name|all>")
+		}
+		reply, err := muxRequest(socket, muxKillRequest, []byte(args[0]))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[+] closed %s connection(s)\n", reply)
+		return nil
+	case "stop":
+		if _, err := muxRequest(socket, muxStopRequest, nil); err != nil {
+			return err
+		}
+		fmt.Println("[+] stopped the daemon")
+		return nil
+	}
+	return fmt.Errorf("unknown daemon command %q, expected run, start, list, kill or stop", command)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// execServer is a SSH server that echoes the command of exec requests and exits with status 3
+func execServer(t *testing.T) *ssh.Client {
+	return exitServer(t, 3)
+}
+
+// exitServer is a SSH server that echoes the command of exec requests and exits with the status
+func exitServer(t *testing.T, status uint32) *ssh.Client {
+	return transferServer(t, func(ch ssh.Channel, typ, arg string) uint32 {
+		ch.Write([]byte(arg))
+		return status
+	}).Client
+}
+
+func TestMuxDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	connects := 0
+	d, err := newMuxDaemon(filepath.Join(dir, "mux.sock"), time.Minute, func(pair *instancePair, user string) (*sshForwardingClient, string, error) {
+		connects++
+		return &sshForwardingClient{false, execServer(t), false}, "admin", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Settings = muxSettings()
+	if err := d.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	go d.Serve()
+
+	pair := &instancePair{
+		Bastion:  &instance{ID: "i-bastion", Name: "web.bastion", PublicIP: "203.0.113.1"},
+		Instance: &instance{ID: "i-web", Name: "web.prod", PrivateIP: "10.0.0.1"},
+	}
+	for n := 0; n < 2; n++ {
+		client, err := connectMux(&tunnelConfig{Mux: d.Socket}, pair, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stdout bytes.Buffer
+		err = Exec(client, "uptime", &stdout, ioutil.Discard)
+		if exitErr, ok := err.(*ssh.ExitError); !ok || exitErr.ExitStatus() != 3 {
+			t.Errorf("Expected exit status 3, got %v", err)
+		}
+		if stdout.String() != "uptime" {
+			t.Errorf("Expected output %q, got %q", "uptime", stdout.String())
+		}
+		client.Close()
+	}
+	if connects != 1 {
+		t.Errorf("Expected the connection to be reused, connected %d times", connects)
+	}
+
+	list := d.list()
+	if len(list) != 1 || list[0].ID != "i-web" || list[0].User != "admin" {
+		t.Fatalf("Unexpected connections %+v", list)
+	}
+	if n := d.kill("web.prod"); n != 1 {
+		t.Errorf("Expected 1 connection to be killed, got %d", n)
+	}
+	if list := d.list(); len(list) != 0 {
+		t.Errorf("Expected no connections after kill, got %+v", list)
+	}
+}
+
+// serveMuxDaemon starts a daemon in the directory and returns a channel that is closed when it stops serving
+func serveMuxDaemon(t *testing.T, dir string, idle time.Duration, connect func(*instancePair, string) (*sshForwardingClient, string, error)) (*muxDaemon, chan struct{}) {
+	d, err := newMuxDaemon(filepath.Join(dir, "mux.sock"), idle, connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Settings = muxSettings()
+	if err := d.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		d.Serve()
+		close(done)
+	}()
+	return d, done
+}
+
+func testPair() *instancePair {
+	return &instancePair{
+		Bastion:  &instance{ID: "i-bastion", Name: "web.bastion", PublicIP: "203.0.113.1"},
+		Instance: &instance{ID: "i-web", Name: "web.prod", PrivateIP: "10.0.0.1"},
+	}
+}
+
+func TestPrivateDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits don't apply on Windows")
+	}
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "salio")
+	if err := privateDir(private); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(private); err != nil {
+		t.Errorf("Expected an existing private directory to be used, got %s", err)
+	}
+
+	shared := filepath.Join(dir, "shared")
+	if err := os.Mkdir(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(shared, 0777)
+	if err := privateDir(shared); err == nil {
+		t.Errorf("Expected a directory that others can write to to be refused")
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(private, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(link); err == nil {
+		t.Errorf("Expected a symlink to be refused")
+	}
+}
+
+func TestMuxDaemonChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostKey := testHostKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	connects := 0
+	d, _ := serveMuxDaemon(t, dir, time.Minute, func(pair *instancePair, user string) (*sshForwardingClient, string, error) {
+		connects++
+		if connects == 1 {
+			return nil, "", &unknownHostKeyError{Hostname: "10.0.0.1:22", Remote: addr, Key: hostKey, File: "known_hosts"}
+		}
+		return &sshForwardingClient{false, execServer(t), false}, "admin", nil
+	})
+	defer d.Stop()
+
+	// the client checks the host key the daemon didn't know and asks again
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{"10.0.0.1:22"}, hostKey) + "\n"
+	if err := ioutil.WriteFile(knownHosts, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hostKeys, err := newHostKeyVerifier(knownHosts, hostKeyStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := connectMux(&tunnelConfig{Mux: d.Socket, HostKeys: hostKeys}, testPair(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if connects != 2 {
+		t.Errorf("Expected the daemon to connect again once the host key was checked, got %d connects", connects)
+	}
+
+	// clients with other authentication settings are refused
+	d.Settings = "-i=other"
+	if _, err := connectMux(&tunnelConfig{Mux: d.Socket}, testPair(), ""); err == nil || !strings.Contains(err.Error(), "other settings") {
+		t.Errorf("Expected a client with other settings to be refused, got %v", err)
+	}
+}
+
+func TestMuxDaemonExpires(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var upstream *ssh.Client
+	d, done := serveMuxDaemon(t, dir, 100*time.Millisecond, func(pair *instancePair, user string) (*sshForwardingClient, string, error) {
+		upstream = execServer(t)
+		return &sshForwardingClient{false, upstream, false}, "admin", nil
+	})
+	closed := make(chan string, 1)
+	d.closeBastion = func(id string) { closed <- id }
+
+	client, err := connectMux(&tunnelConfig{Mux: d.Socket}, testPair(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the idle daemon to exit")
+	}
+	if id := <-closed; id != "i-bastion" {
+		t.Errorf("Expected the connection to the bastion to be closed, got %s", id)
+	}
+	if _, _, err := upstream.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Errorf("Expected the idle connection to the instance to be closed")
+	}
+	if _, err := os.Stat(d.Socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed, got %v", err)
+	}
+}
+
+// forwardServer is a SSH server that accepts remote forwards on 127.0.0.1
+func forwardServer(t *testing.T) *ssh.Client {
+	l, _ := testSSHServer(t, nil, func(serverConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go func() {
+			for req := range reqs {
+				if req.Type != "tcpip-forward" {
+					req.Reply(false, nil)
+					continue
+				}
+				var msg struct {
+					Addr string
+					Port uint32
+				}
+				ssh.Unmarshal(req.Payload, &msg)
+				forwarded, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				port := uint32(forwarded.Addr().(*net.TCPAddr).Port)
+				req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+				go func() {
+					for {
+						c, err := forwarded.Accept()
+						if err != nil {
+							return
+						}
+						payload := ssh.Marshal(&struct {
+							Addr       string
+							Port       uint32
+							OriginAddr string
+							OriginPort uint32
+						}{msg.Addr, port, "127.0.0.1", 1})
+						ch, chReqs, err := serverConn.OpenChannel("forwarded-tcpip", payload)
+						if err != nil {
+							c.Close()
+							continue
+						}
+						go ssh.DiscardRequests(chReqs)
+						go pipe(ch, c)
+					}
+				}()
+			}
+		}()
+		for newChannel := range chans {
+			newChannel.Reject(ssh.Prohibited, "only remote forwards")
+		}
+	})
+	return testSSHClient(t, l)
+}
+
+func TestMuxDaemonRemoteForwardAndStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, done := serveMuxDaemon(t, dir, time.Minute, func(pair *instancePair, user string) (*sshForwardingClient, string, error) {
+		return &sshForwardingClient{false, forwardServer(t), false}, "admin", nil
+	})
+	client, err := connectMux(&tunnelConfig{Mux: d.Socket}, testPair(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	l, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a connection to the port on the instance arrives at the client through the daemon
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected ping through the forward, got %q %v", buf, err)
+	}
+	accepted.Close()
+
+	if _, err := muxRequest(d.Socket, muxStopRequest, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the daemon to stop")
+	}
+	if list := d.list(); len(list) != 0 {
+		t.Errorf("Expected the connections to be closed on stop, got %+v", list)
+	}
+	if _, err := os.Stat(d.Socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed, got %v", err)
+	}
+}
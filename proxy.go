@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// resolveProxyTarget finds exactly one instance for a ProxyCommand target. An instance ID or an exact name is
+// preferred over the fuzzy search, and since there is no terminal to pick from, more than one match is an error.
+func resolveProxyTarget(target string, instances []*instance) (*instancePair, error) {
+	var names []string
+	for _, i := range instances {
+		if i.ID == target || i.Name == target {
+			names = []string{i.Name}
+			break
+		}
+	}
+	if names == nil {
+		names = findInstanceNames(target, instances)
+	}
+
+	var candidates []*instancePair
+	for _, c := range getCandidates(names, instances) {
+		if c.Instance.ID == target {
+			return c, nil
+		}
+		candidates = append(candidates, c)
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("no instances found for %s", target)
+	case 1:
+		return candidates[0], nil
+	}
+	var matches []string
+	for _, c := range candidates {
+		matches = append(matches, fmt.Sprintf("%s (%s)", c.Instance.Name, c.Instance.ID))
+	}
+	return nil, fmt.Errorf("%s matches %d instances, use an instance ID: %s", target, len(candidates), strings.Join(matches, ", "))
+}
+
+// proxyStdio connects to the port on the instance through its bastion and pipes the raw connection over stdin and
+// stdout, so that OpenSSH can use salio as a ProxyCommand and authenticate with the instance end to end.
+func proxyStdio(cfg *tunnelConfig, pair *instancePair, port string, stdin io.Reader, stdout io.Writer) error {
+	tunnelClient, _, err := cfg.tunnel(pair.Bastion)
+	if err != nil {
+		return err
+	}
+	defer cfg.Close()
+
+	conn, err := dialThroughBastion(tunnelClient, net.JoinHostPort(pair.Instance.PrivateIP, port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, stdin)
+		if cw, ok := conn.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	_, err = io.Copy(stdout, conn)
+	return err
+}
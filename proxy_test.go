@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveProxyTarget(t *testing.T) {
+	now := time.Now()
+	bastion := &instance{ID: "i-bastion", Name: "web.bastion", Cluster: "web", IsNat: true, LaunchTime: &now}
+	web1 := &instance{ID: "i-web1", Name: "web.prod", Cluster: "web", Bastions: []*instance{bastion}, LaunchTime: &now}
+	web2 := &instance{ID: "i-web2", Name: "web.prod", Cluster: "web", Bastions: []*instance{bastion}, LaunchTime: &now}
+	db := &instance{ID: "i-db", Name: "web.db", Cluster: "web", Bastions: []*instance{bastion}, LaunchTime: &now}
+	instances := []*instance{bastion, web1, web2, db}
+
+	pair, err := resolveProxyTarget("i-web2", instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair.Instance != web2 {
+		t.Errorf("Expected instance %s, got %s", web2.ID, pair.Instance.ID)
+	}
+	if pair.Bastion != bastion {
+		t.Errorf("Expected bastion %s, got %s", bastion.ID, pair.Bastion.ID)
+	}
+
+	pair, err = resolveProxyTarget("web.db", instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair.Instance != db {
+		t.Errorf("Expected instance %s, got %s", db.ID, pair.Instance.ID)
+	}
+
+	if _, err := resolveProxyTarget("web.prod", instances); err == nil {
+		t.Errorf("Expected an error for a name shared by two instances")
+	}
+}
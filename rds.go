@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// fetchDatabases returns the RDS instances and the writer and reader endpoints of RDS clusters. Instances that are
+// members of a cluster are left out, they are reached through the cluster endpoints.
+func fetchDatabases(config *aws.Config) ([]*endpoint, error) {
+	s := session.Must(session.NewSession(config))
+	svc := rds.New(s, &aws.Config{})
+
+	var databases []*endpoint
+	clusterVPCs := make(map[string]string)
+	err := svc.DescribeDBInstancesPages(&rds.DescribeDBInstancesInput{}, func(page *rds.DescribeDBInstancesOutput, last bool) bool {
+		for _, db := range page.DBInstances {
+			vpcID := ""
+			if db.DBSubnetGroup != nil {
+				vpcID = aws.StringValue(db.DBSubnetGroup.VpcId)
+			}
+			if db.DBClusterIdentifier != nil {
+				clusterVPCs[*db.DBClusterIdentifier] = vpcID
+				continue
+			}
+			if db.Endpoint == nil {
+				// still being created
+				continue
+			}
+			databases = append(databases, &endpoint{
+				Type:     endpointRDS,
+				ID:       aws.StringValue(db.DBInstanceIdentifier),
+				Engine:   aws.StringValue(db.Engine),
+				Host:     aws.StringValue(db.Endpoint.Address),
+				Port:     int(aws.Int64Value(db.Endpoint.Port)),
+				VpcID:    vpcID,
+				Status:   aws.StringValue(db.DBInstanceStatus),
+				User:     aws.StringValue(db.MasterUsername),
+				Database: aws.StringValue(db.DBName),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Aurora Serverless clusters have no member instances to take the VPC from, so it is looked up through the subnet
+	// group of the cluster
+	var subnetGroupVPCs map[string]string
+	input := &rds.DescribeDBClustersInput{}
+	for {
+		resp, err := svc.DescribeDBClusters(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range resp.DBClusters {
+			vpcID := clusterVPCs[aws.StringValue(c.DBClusterIdentifier)]
+			if vpcID == "" && c.DBSubnetGroup != nil {
+				if subnetGroupVPCs == nil {
+					if subnetGroupVPCs, err = fetchSubnetGroupVPCs(svc); err != nil {
+						return nil, err
+					}
+				}
+				vpcID = subnetGroupVPCs[*c.DBSubnetGroup]
+			}
+			databases = append(databases, clusterEndpoints(c, vpcID)...)
+		}
+		if resp.Marker == nil {
+			break
+		}
+		input.Marker = resp.Marker
+	}
+	return databases, nil
+}
+
+// clusterEndpoints returns the writer endpoint of the cluster, and its reader endpoint if it has readers
+func clusterEndpoints(c *rds.DBCluster, vpcID string) []*endpoint {
+	if c.Endpoint == nil {
+		// still being created
+		return nil
+	}
+	writer := &endpoint{
+		Type:     endpointRDS,
+		ID:       aws.StringValue(c.DBClusterIdentifier),
+		Engine:   aws.StringValue(c.Engine),
+		Host:     aws.StringValue(c.Endpoint),
+		Port:     int(aws.Int64Value(c.Port)),
+		VpcID:    vpcID,
+		Status:   aws.StringValue(c.Status),
+		User:     aws.StringValue(c.MasterUsername),
+		Database: aws.StringValue(c.DatabaseName),
+	}
+	endpoints := []*endpoint{writer}
+	if c.ReaderEndpoint != nil && len(c.DBClusterMembers) > 1 {
+		reader := *writer
+		reader.ID += "/reader"
+		reader.Host = *c.ReaderEndpoint
+		endpoints = append(endpoints, &reader)
+	}
+	return endpoints
+}
+
+// fetchSubnetGroupVPCs maps the names of the DB subnet groups to their VPC
+func fetchSubnetGroupVPCs(svc *rds.RDS) (map[string]string, error) {
+	vpcs := make(map[string]string)
+	err := svc.DescribeDBSubnetGroupsPages(&rds.DescribeDBSubnetGroupsInput{}, func(page *rds.DescribeDBSubnetGroupsOutput, last bool) bool {
+		for _, g := range page.DBSubnetGroups {
+			vpcs[aws.StringValue(g.DBSubnetGroupName)] = aws.StringValue(g.VpcId)
+		}
+		return true
+	})
+	return vpcs, err
+}
+
+// databaseURL is the connection string for the database engine at the local end of the forward
+func databaseURL(db *endpoint, user, database, host string, port int) string {
+	hostPort := host + ":" + strconv.Itoa(port)
+	engine := db.Engine
+	switch {
+	case strings.Contains(engine, "postgres"):
+		u := &url.URL{Scheme: "postgresql", Host: hostPort, Path: "/" + database}
+		if user != "" {
+			u.User = url.User(user)
+		}
+		return u.String()
+	case strings.HasPrefix(engine, "aurora"), engine == "mysql", engine == "mariadb":
+		u := &url.URL{Scheme: "mysql", Host: hostPort, Path: "/" + database}
+		if user != "" {
+			u.User = url.User(user)
+		}
+		return u.String()
+	case strings.HasPrefix(engine, "sqlserver"):
+		u := &url.URL{Scheme: "sqlserver", Host: hostPort}
+		if user != "" {
+			u.User = url.User(user)
+		}
+		if database != "" {
+			u.RawQuery = url.Values{"database": {database}}.Encode()
+		}
+		return u.String()
+	case engine == "docdb":
+		u := &url.URL{Scheme: "mongodb", Host: hostPort, Path: "/" + database}
+		if user != "" {
+			u.User = url.User(user)
+		}
+		return u.String()
+	case strings.HasPrefix(engine, "oracle"):
+		return fmt.Sprintf("%s@//%s/%s", user, hostPort, database)
+	}
+	return hostPort
+}
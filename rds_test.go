@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+func TestDatabaseURL(t *testing.T) {
+	tests := []struct {
+		engine, expected string
+	}{
+		{"postgres", "postgresql://app@127.0.0.1:15432/orders"},
+		{"aurora-postgresql", "postgresql://app@127.0.0.1:15432/orders"},
+		{"aurora-mysql", "mysql://app@127.0.0.1:15432/orders"},
+		{"mariadb", "mysql://app@127.0.0.1:15432/orders"},
+		{"sqlserver-ex", "sqlserver://app@127.0.0.1:15432?database=orders"},
+		{"neptune", "127.0.0.1:15432"},
+	}
+	for _, test := range tests {
+		db := &endpoint{Engine: test.engine}
+		if got := databaseURL(db, "app", "orders", "127.0.0.1", 15432); got != test.expected {
+			t.Errorf("Expected %s for %s, got %s", test.expected, test.engine, got)
+		}
+	}
+}
+
+func TestFindEndpoints(t *testing.T) {
+	endpoints := []*endpoint{
+		{ID: "orders-prod", VpcID: "vpc-prod"},
+		{ID: "orders-prod/reader", VpcID: "vpc-prod"},
+		{ID: "users-staging", VpcID: "vpc-staging"},
+	}
+	found := findEndpoints("ordprod", endpoints)
+	if len(found) != 2 || found[0].ID != "orders-prod" || found[1].ID != "orders-prod/reader" {
+		t.Errorf("Expected the orders-prod endpoints, got %+v", found)
+	}
+	if found := findEndpoints("", endpoints); len(found) != 3 {
+		t.Errorf("Expected all endpoints without a search term, got %d", len(found))
+	}
+
+	instances := []*instance{
+		{ID: "i-web", VpcID: "vpc-prod"},
+		{ID: "i-bastion-staging", VpcID: "vpc-staging", IsNat: true, PublicIP: "203.0.113.2"},
+		{ID: "i-bastion-prod", VpcID: "vpc-prod", IsNat: true, PublicIP: "203.0.113.1"},
+	}
+	bastion, err := bastionInVPC(instances, "vpc-prod")
+	if err != nil || bastion.ID != "i-bastion-prod" {
+		t.Errorf("Expected the bastion in vpc-prod, got %+v %v", bastion, err)
+	}
+	if _, err := bastionInVPC(instances, "vpc-dev"); err == nil {
+		t.Errorf("Expected an error for a VPC without bastions")
+	}
+}
+
+func TestClusterEndpoints(t *testing.T) {
+	cluster := &rds.DBCluster{
+		DBClusterIdentifier: aws.String("orders"),
+		Engine:              aws.String("aurora-postgresql"),
+		Endpoint:            aws.String("orders.cluster-abc.rds.amazonaws.com"),
+		ReaderEndpoint:      aws.String("orders.cluster-ro-abc.rds.amazonaws.com"),
+		Port:                aws.Int64(5432),
+		DBClusterMembers:    []*rds.DBClusterMember{{}, {}},
+	}
+	endpoints := clusterEndpoints(cluster, "vpc-prod")
+	if len(endpoints) != 2 {
+		t.Fatalf("Expected a writer and a reader endpoint, got %+v", endpoints)
+	}
+	if e := endpoints[1]; e.ID != "orders/reader" || e.Host != "orders.cluster-ro-abc.rds.amazonaws.com" || e.VpcID != "vpc-prod" || e.Port != 5432 {
+		t.Errorf("Expected the reader endpoint in vpc-prod, got %+v", e)
+	}
+
+	// serverless clusters have no members
+	cluster.DBClusterMembers = nil
+	if endpoints := clusterEndpoints(cluster, "vpc-prod"); len(endpoints) != 1 || endpoints[0].ID != "orders" {
+		t.Errorf("Expected only the writer endpoint of a cluster without readers, got %+v", endpoints)
+	}
+	cluster.Endpoint = nil
+	if endpoints := clusterEndpoints(cluster, "vpc-prod"); len(endpoints) != 0 {
+		t.Errorf("Expected no endpoints for a cluster that is being created, got %+v", endpoints)
+	}
+}
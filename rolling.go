@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rollingRun executes a command across a set of instances in batches, waiting for an optional health check to pass
+// on every instance in a batch before moving on to the next one. The health check is retried every HealthInterval
+// until it passes or HealthTimeout has passed, as services take a while to come back after a restart.
+type rollingRun struct {
+	Command        string
+	BatchSize      string
+	Pause          time.Duration
+	HealthCheck    string
+	HealthTimeout  time.Duration
+	HealthInterval time.Duration
+	MaxFailures    int
+	StateFile      string
+
+	connect func(*instancePair) (*sshForwardingClient, error)
+}
+
+// rollingState is persisted to the state file after every batch so that an aborted run can be resumed
+type rollingState struct {
+	Command   string            `json:"command"`
+	Completed []string          `json:"completed"`
+	Failed    map[string]string `json:"failed"`
+}
+
+type rollingResult struct {
+	Pair   *instancePair
+	Output []byte
+	Err    error
+}
+
+// Run executes the command on all candidates. Instances that completed in a previous run with the same state file
+// are skipped.
+func (r *rollingRun) Run(candidates []*instancePair) error {
+	state, err := r.loadState()
+	if err != nil {
+		return err
+	}
+
+	done := make(map[string]bool)
+	for _, id := range state.Completed {
+		done[id] = true
+	}
+
+	var pending []*instancePair
+	for _, c := range candidates {
+		if done[c.Instance.ID] {
+			fmt.Printf("[+] skipping %s (%s), already completed\n", c.Instance.Name, c.Instance.ID)
+			continue
+		}
+		pending = append(pending, c)
+	}
+
+	// a resumed run splits the remaining instances the same way, e.g. 50% still takes two batches
+	size, err := parseBatchSize(r.BatchSize, len(pending))
+	if err != nil {
+		return err
+	}
+
+	batches := (len(pending) + size - 1) / size
+	failures := 0
+	for b := 0; b < batches; b++ {
+		if b > 0 && r.Pause > 0 {
+			fmt.Printf("[+] pausing for %s\n", r.Pause)
+			time.Sleep(r.Pause)
+		}
+
+		end := (b + 1) * size
+		if end > len(pending) {
+			end = len(pending)
+		}
+		batch := pending[b*size : end]
+
+		fmt.Printf("[+] batch %d/%d: %s\n", b+1, batches, instanceNames(batch))
+		results := r.runBatch(batch)
+
+		ok := 0
+		for _, res := range results {
+			printPrefixed(res.Pair.Instance.Name, res.Output)
+			if res.Err != nil {
+				fmt.Printf("[!] %s (%s) failed: %s\n", res.Pair.Instance.Name, res.Pair.Instance.ID, res.Err)
+				state.Failed[res.Pair.Instance.ID] = res.Err.Error()
+				failures++
+				continue
+			}
+			delete(state.Failed, res.Pair.Instance.ID)
+			state.Completed = append(state.Completed, res.Pair.Instance.ID)
+			ok++
+		}
+		fmt.Printf("[+] batch %d/%d finished: %d ok, %d failed\n", b+1, batches, ok, len(results)-ok)
+
+		if err := r.saveState(state); err != nil {
+			return err
+		}
+
+		if r.MaxFailures > 0 && failures >= r.MaxFailures {
+			return fmt.Errorf("aborting after %d failure(s), %d instance(s) not attempted", failures, len(pending)-end)
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("run finished with %d failure(s)", failures)
+	}
+
+	fmt.Printf("[+] run finished on %d instance(s)\n", len(pending))
+	if r.StateFile != "" {
+		return os.Remove(r.StateFile)
+	}
+	return nil
+}
+
+// runBatch runs the command and health check on all instances in the batch concurrently
+func (r *rollingRun) runBatch(batch []*instancePair) []*rollingResult {
+	results := make([]*rollingResult, len(batch))
+	var wg sync.WaitGroup
+	for i := range batch {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = r.runOne(batch[i])
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func (r *rollingRun) runOne(pair *instancePair) *rollingResult {
+	res := &rollingResult{Pair: pair}
+	out := &syncBuffer{}
+
+	client, err := r.connect(pair)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer client.Close()
+
+	if err := Exec(client, r.Command, out, out); err != nil {
+		res.Output = out.Bytes()
+		res.Err = err
+		return res
+	}
+
+	if r.HealthCheck != "" {
+		// only the output of the last attempt is kept
+		var check *syncBuffer
+		err := retryUntil(r.HealthTimeout, r.HealthInterval, func() error {
+			check = &syncBuffer{}
+			return Exec(client, r.HealthCheck, check, check)
+		})
+		out.Write(check.Bytes())
+		if err != nil {
+			res.Err = fmt.Errorf("health check failed: %s", err)
+		}
+	}
+	res.Output = out.Bytes()
+	return res
+}
+
+// retryUntil calls check every interval until it succeeds or the timeout has passed, and returns the last error. An
+// attempt that is still running at the timeout is abandoned. Without a timeout check is called once.
+func retryUntil(timeout, interval time.Duration, check func() error) error {
+	if timeout <= 0 {
+		return check()
+	}
+	deadline := time.After(timeout)
+	for attempt := 1; ; attempt++ {
+		done := make(chan error, 1)
+		go func() { done <- check() }()
+		var err error
+		select {
+		case err = <-done:
+		case <-deadline:
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-deadline:
+			return fmt.Errorf("%s, gave up after %d attempt(s) in %s", err, attempt, timeout)
+		}
+	}
+}
+
+// syncBuffer is a buffer that the stdout and stderr of a session can be copied to concurrently
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+func (r *rollingRun) loadState() (*rollingState, error) {
+	state := &rollingState{
+		Command: r.Command,
+		Failed:  make(map[string]string),
+	}
+	if r.StateFile == "" {
+		return state, nil
+	}
+
+	data, err := ioutil.ReadFile(r.StateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not read state file %s: %s", r.StateFile, err)
+	}
+	if state.Command != r.Command {
+		return nil, fmt.Errorf("state file %s belongs to a different command: %q", r.StateFile, state.Command)
+	}
+	if state.Failed == nil {
+		state.Failed = make(map[string]string)
+	}
+	return state, nil
+}
+
+func (r *rollingRun) saveState(state *rollingState) error {
+	if r.StateFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.StateFile, data, 0644)
+}
+
+// parseBatchSize converts a batch size such as "2" or "25%" into a number of instances. An empty size means all
+// instances in one batch.
+func parseBatchSize(size string, total int) (int, error) {
+	if total < 1 {
+		total = 1
+	}
+	if size == "" {
+		return total, nil
+	}
+
+	if strings.HasSuffix(size, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(size, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("invalid batch size %q", size)
+		}
+		n := int(math.Ceil(float64(total) * percent / 100))
+		if n < 1 {
+			n = 1
+		}
+		return n, nil
+	}
+
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 1 {
+		return 0, errors.New("batch size must be a positive number or percentage")
+	}
+	return n, nil
+}
+
+func instanceNames(pairs []*instancePair) string {
+	var names []string
+	for _, p := range pairs {
+		names = append(names, p.Instance.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// printPrefixed prints each line of output prefixed with the instance name
+func printPrefixed(name string, output []byte) {
+	for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		fmt.Printf("%s | %s\n", name, line)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseBatchSize(t *testing.T) {
+	tests := []struct {
+		size     string
+		total    int
+		expected int
+	}{
+		{"", 5, 5},
+		{"2", 5, 2},
+		{"25%", 8, 2},
+		{"25%", 5, 2},
+		{"1%", 5, 1},
+		{"100%", 5, 5},
+	}
+
+	for _, test := range tests {
+		actual, err := parseBatchSize(test.size, test.total)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s", test.size, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("Expected batch size %d for %q of %d, got %d", test.expected, test.size, test.total, actual)
+		}
+	}
+
+	for _, size := range []string{"0", "-1", "0%", "150%", "two"} {
+		if _, err := parseBatchSize(size, 5); err == nil {
+			t.Errorf("Expected error for batch size %q", size)
+		}
+	}
+}
+
+func TestRollingRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var candidates []*instancePair
+	for i := 0; i < 5; i++ {
+		id := "i-" + strconv.Itoa(i)
+		candidates = append(candidates, &instancePair{Bastion: &instance{}, Instance: &instance{ID: id, Name: "web" + id}})
+	}
+
+	var mu sync.Mutex
+	var attempted []string
+	unreachable := map[string]bool{"i-0": true}
+	r := &rollingRun{
+		Command:     "uptime",
+		BatchSize:   "2",
+		MaxFailures: 1,
+		StateFile:   filepath.Join(dir, "state.json"),
+		connect: func(pair *instancePair) (*sshForwardingClient, error) {
+			mu.Lock()
+			attempted = append(attempted, pair.Instance.ID)
+			failing := unreachable[pair.Instance.ID]
+			mu.Unlock()
+			if failing {
+				return nil, errors.New("connection refused")
+			}
+			return &sshForwardingClient{false, exitServer(t, 0), false}, nil
+		},
+	}
+
+	// the first batch finishes before the run aborts, the later batches are not attempted
+	if err := r.Run(candidates); err == nil {
+		t.Fatal("Expected the run to abort after the first failure")
+	}
+	sort.Strings(attempted)
+	if len(attempted) != 2 || attempted[0] != "i-0" || attempted[1] != "i-1" {
+		t.Errorf("Expected only the first batch to be attempted, got %v", attempted)
+	}
+	data, err := ioutil.ReadFile(r.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &rollingState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Completed) != 1 || state.Completed[0] != "i-1" || state.Failed["i-0"] == "" {
+		t.Errorf("Expected i-1 completed and i-0 failed, got %+v", state)
+	}
+
+	// resuming skips the completed instance and removes the state file when all succeed
+	attempted = nil
+	unreachable = map[string]bool{}
+	if err := r.Run(candidates); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(attempted)
+	if len(attempted) != 4 || attempted[0] != "i-0" || attempted[1] != "i-2" {
+		t.Errorf("Expected all but i-1 to be attempted, got %v", attempted)
+	}
+	if _, err := os.Stat(r.StateFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the state file to be removed, got %v", err)
+	}
+}
+
+func TestRetryUntil(t *testing.T) {
+	calls := 0
+	err := retryUntil(time.Second, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected the check to pass on the third attempt, got %d attempts and %v", calls, err)
+	}
+
+	err = retryUntil(50*time.Millisecond, 10*time.Millisecond, func() error {
+		return errors.New("connection refused")
+	})
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Expected the last error after the timeout, got %v", err)
+	}
+
+	// an attempt that hangs is abandoned at the timeout
+	block := make(chan struct{})
+	defer close(block)
+	err = retryUntil(50*time.Millisecond, 10*time.Millisecond, func() error {
+		<-block
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected a hanging check to time out, got %v", err)
+	}
+
+	calls = 0
+	retryUntil(0, time.Millisecond, func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	if calls != 1 {
+		t.Errorf("Expected a single attempt without a timeout, got %d", calls)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scpTransfer copies files by running scp in sink (-t) or source (-f) mode on the instance and speaking the scp
+// protocol over the session. It is used for hosts that do not offer the sftp subsystem.
+type scpTransfer struct {
+	client   *sshForwardingClient
+	progress bool
+}
+
+func (t *scpTransfer) Close() error {
+	return nil
+}
+
+// scpSession is a running remote scp process
+type scpSession struct {
+	session *ssh.Session
+	w       io.WriteCloser
+	r       *bufio.Reader
+	stderr  bytes.Buffer
+}
+
+func (t *scpTransfer) start(args, remotePath string) (*scpSession, error) {
+	session, err := t.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	s := &scpSession{session: session}
+	session.Stderr = &s.stderr
+	if s.w, err = session.StdinPipe(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	s.r = bufio.NewReader(stdout)
+
+	if remotePath == "" {
+		remotePath = "."
+	}
+	if err := session.Start(fmt.Sprintf("scp %s -- %s", args, shellPath(remotePath))); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// finish closes the session and waits for the remote scp to exit
+func (s *scpSession) finish(err error) error {
+	s.w.Close()
+	waitErr := s.session.Wait()
+	s.session.Close()
+	if err == nil {
+		err = waitErr
+	}
+	if err != nil && s.stderr.Len() > 0 {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(s.stderr.String()))
+	}
+	return err
+}
+
+// readAck reads a response from the remote scp, which is a zero byte or an error message
+func (s *scpSession) readAck() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := s.r.ReadString('\n')
+	if b == 1 || b == 2 {
+		return errors.New(strings.TrimSpace(msg))
+	}
+	return fmt.Errorf("scp: unexpected response %q", string(b)+msg)
+}
+
+func (s *scpSession) ack() error {
+	_, err := s.w.Write([]byte{0})
+	return err
+}
+
+func (t *scpTransfer) Upload(localPath, remotePath string, recursive bool) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !recursive {
+		return fmt.Errorf("%s is a directory, use -r to copy directories", localPath)
+	}
+
+	args := "-t -p"
+	if recursive {
+		args += " -r"
+	}
+	s, err := t.start(args, remotePath)
+	if err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		return s.finish(err)
+	}
+	return s.finish(t.send(s, localPath, info))
+}
+
+// send writes a file or directory to the remote scp sink
+func (t *scpTransfer) send(s *scpSession, localPath string, info os.FileInfo) error {
+	mtime := info.ModTime().Unix()
+	if _, err := fmt.Fprintf(s.w, "T%d 0 %d 0\n", mtime, mtime); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if _, err := fmt.Fprintf(s.w, "D%04o 0 %s\n", info.Mode().Perm(), info.Name()); err != nil {
+			return err
+		}
+		if err := s.readAck(); err != nil {
+			return err
+		}
+		entries, err := ioutil.ReadDir(localPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			child := filepath.Join(localPath, entry.Name())
+			childInfo, err := os.Stat(child)
+			if err != nil {
+				return err
+			}
+			if !childInfo.IsDir() && !childInfo.Mode().IsRegular() {
+				fmt.Printf("[!] skipping %s, not a regular file\n", child)
+				continue
+			}
+			if err := t.send(s, child, childInfo); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprint(s.w, "E\n"); err != nil {
+			return err
+		}
+		return s.readAck()
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(s.w, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), info.Name()); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	bar := newProgressBar(localPath, info.Size(), t.progress)
+	if _, err := io.CopyN(io.MultiWriter(s.w, bar), f, info.Size()); err != nil {
+		return err
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	bar.Finish()
+	return nil
+}
+
+// scpDir is a directory that is being received, its times are applied once all its entries have been written
+type scpDir struct {
+	path  string
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (t *scpTransfer) Download(remotePath, localPath string, recursive bool) error {
+	args := "-f -p"
+	if recursive {
+		args += " -r"
+	}
+	s, err := t.start(args, remotePath)
+	if err != nil {
+		return err
+	}
+	return s.finish(t.receive(s, localPath))
+}
+
+// receive reads files and directories from the remote scp source. If localPath is an existing directory entries are
+// created inside it, otherwise the top level entry is created as localPath.
+func (t *scpTransfer) receive(s *scpSession, localPath string) error {
+	intoDir := false
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		intoDir = true
+	}
+
+	var dirs []*scpDir
+	var mtime time.Time
+	if err := s.ack(); err != nil {
+		return err
+	}
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("scp: unexpected empty message")
+		}
+
+		switch line[0] {
+		case 1, 2:
+			return errors.New(line[1:])
+		case 'T':
+			fields := strings.Fields(line[1:])
+			if len(fields) != 4 {
+				return fmt.Errorf("scp: invalid time message %q", line)
+			}
+			sec, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("scp: invalid time message %q", line)
+			}
+			mtime = time.Unix(sec, 0)
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("scp: unexpected end of directory")
+			}
+			dir := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if err := chmtime(dir.path, dir.mode, dir.mtime); err != nil {
+				return err
+			}
+		case 'C', 'D':
+			fields := strings.SplitN(line[1:], " ", 3)
+			if len(fields) != 3 {
+				return fmt.Errorf("scp: invalid message %q", line)
+			}
+			mode, err := strconv.ParseUint(fields[0], 8, 32)
+			if err != nil {
+				return fmt.Errorf("scp: invalid mode in %q", line)
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("scp: invalid size in %q", line)
+			}
+			name := fields[2]
+			if name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+				return fmt.Errorf("scp: refusing unsafe file name %q", name)
+			}
+
+			target := localPath
+			if len(dirs) > 0 {
+				target = filepath.Join(dirs[len(dirs)-1].path, name)
+			} else if intoDir {
+				target = filepath.Join(localPath, name)
+			}
+
+			if line[0] == 'D' {
+				if err := os.Mkdir(target, os.FileMode(mode)|0700); err != nil && !os.IsExist(err) {
+					return err
+				}
+				dirs = append(dirs, &scpDir{target, os.FileMode(mode), mtime})
+				break
+			}
+
+			if err := s.ack(); err != nil {
+				return err
+			}
+			if err := t.receiveFile(s, target, os.FileMode(mode), size); err != nil {
+				return err
+			}
+			if err := s.readAck(); err != nil {
+				return err
+			}
+			if !mtime.IsZero() {
+				if err := chmtime(target, os.FileMode(mode), mtime); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("scp: unexpected message %q", line)
+		}
+		if err := s.ack(); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *scpTransfer) receiveFile(s *scpSession, target string, mode os.FileMode, size int64) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode|0200)
+	if err != nil {
+		return err
+	}
+	bar := newProgressBar(target, size, t.progress)
+	if _, err := io.CopyN(io.MultiWriter(f, bar), s.r, size); err != nil {
+		f.Close()
+		return err
+	}
+	bar.Finish()
+	return f.Close()
+}
+
+// shellQuote quotes a string so that it is passed as a single word to a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellPath quotes a remote path like shellQuote but leaves a leading ~ unquoted, so the shell still expands it to
+// the home directory
+func shellPath(p string) string {
+	if p == "~" {
+		return p
+	}
+	if strings.HasPrefix(p, "~/") {
+		return "~/" + shellQuote(p[2:])
+	}
+	return shellQuote(p)
+}
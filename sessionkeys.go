@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentKeyPrefix selects a CA key held by the ssh-agent instead of a key file
+const agentKeyPrefix = "agent:"
+
+// loadCASigner returns the signer for the CA key, either a private key file or "agent:" followed by the SHA256
+// fingerprint or the comment of a key in the ssh-agent
+func loadCASigner(spec string) (ssh.Signer, error) {
+	if !strings.HasPrefix(spec, agentKeyPrefix) {
+		key, err := loadPrivateKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.NewSignerFromKey(key)
+	}
+
+	agentClient, err := sshAgentClient()
+	if err != nil {
+		return nil, err
+	}
+	return findAgentSigner(agentClient, strings.TrimPrefix(spec, agentKeyPrefix))
+}
+
+// findAgentSigner returns the signer for the agent key with the SHA256 fingerprint or comment
+func findAgentSigner(a agent.Agent, selector string) (ssh.Signer, error) {
+	keys, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+	var match *agent.Key
+	for _, k := range keys {
+		if k.Comment == selector || ssh.FingerprintSHA256(k) == selector {
+			match = k
+			break
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no key matching %s in the ssh-agent", selector)
+	}
+
+	signers, err := a.Signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), match.Marshal()) {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no key matching %s in the ssh-agent", selector)
+}
+
+// sessionAgent is an in-memory agent holding a freshly generated ed25519 key and a user certificate for it signed by
+// the CA. The key only lives as long as the process. It is replaced with a new one once less than half of the
+// validity of its certificate is left, so that long running processes such as the daemon and detached tunnels can
+// still authenticate new connections, or once the principals change, e.g. when an instance has its own user.
+type sessionAgent struct {
+	ca         ssh.Signer
+	principals func() []string
+	validity   time.Duration
+
+	mu        sync.Mutex
+	keyring   agent.Agent
+	expires   time.Time
+	signedFor string
+}
+
+func newSessionAgent(ca ssh.Signer, principals func() []string, validity time.Duration) (agent.Agent, error) {
+	a := &sessionAgent{ca: ca, principals: principals, validity: validity}
+	if _, err := a.current(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// current returns the keyring with a certificate for the current principals that is valid for at least half of the
+// validity
+func (a *sessionAgent) current() (agent.Agent, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	principals := a.principals()
+	signedFor := strings.Join(principals, ",")
+	if a.keyring != nil && time.Until(a.expires) > a.validity/2 && a.signedFor == signedFor {
+		return a.keyring, nil
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cert, err := signSessionCert(a.ca, pub, principals, a.validity, now)
+	if err != nil {
+		return nil, err
+	}
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{
+		PrivateKey:   priv,
+		Certificate:  cert,
+		Comment:      cert.KeyId,
+		LifetimeSecs: uint32(a.validity / time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "[+] session certificate %s valid for %s as %s\n", cert.KeyId, a.validity, strings.Join(principals, ", "))
+	a.keyring, a.expires, a.signedFor = keyring, now.Add(a.validity), signedFor
+	return keyring, nil
+}
+
+func (a *sessionAgent) List() ([]*agent.Key, error) {
+	keyring, err := a.current()
+	if err != nil {
+		return nil, err
+	}
+	return keyring.List()
+}
+
+func (a *sessionAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	keyring, err := a.current()
+	if err != nil {
+		return nil, err
+	}
+	return keyring.Sign(key, data)
+}
+
+func (a *sessionAgent) Signers() ([]ssh.Signer, error) {
+	keyring, err := a.current()
+	if err != nil {
+		return nil, err
+	}
+	return keyring.Signers()
+}
+
+func (a *sessionAgent) Add(key agent.AddedKey) error {
+	return errors.New("the session agent only holds session keys")
+}
+
+func (a *sessionAgent) Remove(key ssh.PublicKey) error {
+	return errors.New("the session agent only holds session keys")
+}
+
+func (a *sessionAgent) RemoveAll() error {
+	return errors.New("the session agent only holds session keys")
+}
+
+func (a *sessionAgent) Lock(passphrase []byte) error {
+	return errors.New("the session agent can't be locked")
+}
+
+func (a *sessionAgent) Unlock(passphrase []byte) error {
+	return errors.New("the session agent can't be locked")
+}
+
+// signSessionCert signs a user certificate for the key. The start of the validity is backdated a little to allow
+// for clock skew between this machine and the hosts.
+func signSessionCert(ca ssh.Signer, key ed25519.PublicKey, principals []string, validity time.Duration, now time.Time) (*ssh.Certificate, error) {
+	pub, err := ssh.NewPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+
+	id := "salio"
+	if hostname, err := os.Hostname(); err == nil {
+		id += "@" + hostname
+	}
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("%s-%d", id, now.Unix()),
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSessionAgent(t *testing.T) {
+	ca := testSigner(t)
+	a, err := newSessionAgent(ca, func() []string { return []string{"ubuntu", "admin"} }, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers, err := a.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("Expected one session key, got %d", len(signers))
+	}
+	cert, ok := signers[0].PublicKey().(*ssh.Certificate)
+	if !ok {
+		t.Fatalf("Expected the session key to be a certificate, got %s", signers[0].PublicKey().Type())
+	}
+	if cert.Key.Type() != ssh.KeyAlgoED25519 {
+		t.Errorf("Expected an ed25519 key, got %s", cert.Key.Type())
+	}
+
+	checker := &ssh.CertChecker{}
+	for _, user := range []string{"ubuntu", "admin"} {
+		if err := checker.CheckCert(user, cert); err != nil {
+			t.Errorf("Expected the certificate to be valid for %s, got %s", user, err)
+		}
+	}
+	if err := checker.CheckCert("root", cert); err == nil {
+		t.Errorf("Expected the certificate to be invalid for root")
+	}
+	checker.Clock = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if err := checker.CheckCert("ubuntu", cert); err == nil {
+		t.Errorf("Expected the certificate to expire after the validity")
+	}
+}
+
+func TestSessionAgentRenews(t *testing.T) {
+	principals := []string{"ubuntu"}
+	a, err := newSessionAgent(testSigner(t), func() []string { return principals }, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := a.List()
+	if again, _ := a.List(); len(again) != 1 || again[0].Comment != first[0].Comment {
+		t.Errorf("Expected the certificate to be reused while it is valid, got %v", again)
+	}
+
+	// half of the validity has passed
+	a.(*sessionAgent).expires = time.Now().Add(29 * time.Second)
+	renewed, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renewed) != 1 || string(renewed[0].Blob) == string(first[0].Blob) {
+		t.Errorf("Expected a new session certificate, got %v", renewed)
+	}
+
+	// an instance with its own user was found
+	principals = []string{"ubuntu", "deploy"}
+	signers, err := a.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := signers[0].PublicKey().(*ssh.Certificate)
+	if err := (&ssh.CertChecker{}).CheckCert("deploy", cert); err != nil {
+		t.Errorf("Expected the certificate to be renewed for the new principal, got %s", err)
+	}
+}
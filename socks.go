@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SOCKS5 protocol constants, see RFC 1928
+const (
+	socksVersion        = 0x05
+	socksNoAuth         = 0x00
+	socksNoAcceptable   = 0xff
+	socksCmdConnect     = 0x01
+	socksAddrIPv4       = 0x01
+	socksAddrDomain     = 0x03
+	socksAddrIPv6       = 0x04
+	socksSucceeded      = 0x00
+	socksFailure        = 0x01
+	socksCmdNotSupport  = 0x07
+	socksAddrNotSupport = 0x08
+)
+
+// parseListenAddr parses a [bind_address:]port into a listen address that defaults to localhost
+func parseListenAddr(addr string) (string, error) {
+	if !strings.Contains(addr, ":") {
+		addr = net.JoinHostPort("localhost", addr)
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid port in %q", addr)
+	}
+	return addr, nil
+}
+
+// socksProxy starts a SOCKS5 server on the listen address that supports the CONNECT command without authentication.
+// Each requested destination is dialled from the target instance, so domain names are resolved on the remote side.
+// Closing the returned listener stops the proxy.
+func socksProxy(client *sshForwardingClient, listenAddr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("[+] SOCKS5 proxy listening on %s\n", listener.Addr())
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if err := serveSocks(conn, client.Dial); err != nil {
+					fmt.Printf("[!] socks: %s\r\n", err)
+				}
+			}()
+		}
+	}()
+	return listener, nil
+}
+
+// serveSocks handles a single SOCKS5 client connection
+func serveSocks(conn net.Conn, dial func(network, addr string) (net.Conn, error)) error {
+	reader := bufio.NewReader(conn)
+
+	// greeting: version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		conn.Close()
+		return err
+	}
+	if header[0] != socksVersion {
+		conn.Close()
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		conn.Close()
+		return err
+	}
+	if !containsByte(methods, socksNoAuth) {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		conn.Close()
+		return errors.New("client does not support unauthenticated connections")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		conn.Close()
+		return err
+	}
+	if request[1] != socksCmdConnect {
+		socksReply(conn, socksCmdNotSupport)
+		conn.Close()
+		return fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if request[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			conn.Close()
+			return err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		domain := make([]byte, length)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			conn.Close()
+			return err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAddrNotSupport)
+		conn.Close()
+		return fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		conn.Close()
+		return err
+	}
+	destination := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	fmt.Printf("[+] socks: connecting to %s\r\n", destination)
+	target, err := dial("tcp", destination)
+	if err != nil {
+		socksReply(conn, socksFailure)
+		conn.Close()
+		return fmt.Errorf("connect to %s: %s", destination, err)
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		target.Close()
+		conn.Close()
+		return err
+	}
+
+	// the client may already have sent data that is sitting in the buffered reader
+	pipe(&bufferedConn{conn, reader}, target)
+	return nil
+}
+
+// socksReply writes a reply with the given status and an empty IPv4 bind address
+func socksReply(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{socksVersion, status, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func containsByte(haystack []byte, needle byte) bool {
+	for _, b := range haystack {
+		if b == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedConn is a net.Conn that reads through a bufio.Reader wrapping it
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestServeSocksPassesDomainToDial(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	dialled := make(chan string, 1)
+	dial := func(network, addr string) (net.Conn, error) {
+		dialled <- addr
+		remote, other := net.Pipe()
+		go io.Copy(other, other)
+		return remote, nil
+	}
+	go serveSocks(server, dial)
+
+	if _, err := client.Write([]byte{socksVersion, 1, socksNoAuth}); err != nil {
+		t.Fatal(err)
+	}
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(client, greeting); err != nil {
+		t.Fatal(err)
+	}
+	if greeting[1] != socksNoAuth {
+		t.Fatalf("Expected no auth method to be selected, got %d", greeting[1])
+	}
+
+	domain := "db.internal"
+	request := []byte{socksVersion, socksCmdConnect, 0x00, socksAddrDomain, byte(len(domain))}
+	request = append(request, domain...)
+	request = append(request, 0x15, 0x38)
+	if _, err := client.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socksSucceeded {
+		t.Errorf("Expected reply status %d, got %d", socksSucceeded, reply[1])
+	}
+
+	if addr := <-dialled; addr != "db.internal:5432" {
+		t.Errorf("Expected dial to db.internal:5432, got %s", addr)
+	}
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(client, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != "ping" {
+		t.Errorf("Expected echo of ping, got %q", echo)
+	}
+}
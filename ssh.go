@@ -7,48 +7,292 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-func newTunnelledSSHClient(bastionUser, instanceUser, bastionAddress, instanceAddress string) (*sshForwardingClient, error) {
-	fmt.Printf("[+] trying %s@%s via %s@%s\n", instanceUser, instanceAddress, bastionUser, bastionAddress)
-	bastionAddress = maybeAddDefaultPort(bastionAddress)
-	instanceAddress = maybeAddDefaultPort(instanceAddress)
+// tunnelConfig holds the settings used for both hops of a connection
+type tunnelConfig struct {
+	BastionUser  string
+	InstanceUser string
+	HostKeys     *hostKeyVerifier
+	CertFiles    []string
+	// Agent replaces the ssh-agent for authentication and forwarding, e.g. with an agent holding session keys
+	Agent agent.Agent
+	// Identities returns the Agent when it is first needed, so that commands that don't connect don't ask for
+	// passphrases. A nil agent means the ssh-agent is used.
+	Identities func() (agent.Agent, error)
+	// BastionKeys and InstanceKeys select the keys offered to each hop, see selectSigners
+	BastionKeys  []string
+	InstanceKeys []string
+	LastKeys     *lastKeys
+	Forwarding   *agentForwarding
+	LoginUsers   *loginUsers
+	// Mux is the socket of the daemon holding connections to instances, if connections should go through it
+	Mux string
 
-	agentClient, err := sshAgentClient()
+	mu             sync.Mutex
+	bastions       map[string]*bastionTunnel
+	identitiesOnce sync.Once
+	identitiesErr  error
+	// sshAgent is the connection to the ssh-agent, dialed once and shared by all connections
+	sshAgent  agent.Agent
+	agentConn net.Conn
+}
+
+// bastionTunnel is an authenticated connection to a bastion that is shared by all connections through it
+type bastionTunnel struct {
+	mu      sync.Mutex
+	client  *ssh.Client
+	signers []ssh.Signer
+	closed  chan struct{}
+}
+
+// tunnel returns the open connection to the bastion and the signers to use for the next hop. The bastion is dialed if
+// there is no connection yet or the last one was lost.
+func (cfg *tunnelConfig) tunnel(bastion *instance) (*ssh.Client, []ssh.Signer, error) {
+	cfg.mu.Lock()
+	if cfg.bastions == nil {
+		cfg.bastions = make(map[string]*bastionTunnel)
+	}
+	t, ok := cfg.bastions[bastion.ID]
+	if !ok {
+		t = &bastionTunnel{}
+		cfg.bastions[bastion.ID] = t
+	}
+	cfg.mu.Unlock()
+
+	// only the first caller dials, the others wait for it
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		select {
+		case <-t.closed:
+			t.client = nil
+		default:
+			return t.client, t.signers, nil
+		}
+	}
+
+	client, signers, err := dialBastion(cfg, bastion)
 	if err != nil {
+		return nil, nil, err
+	}
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	t.client, t.signers, t.closed = client, signers, closed
+	return client, signers, nil
+}
+
+// Close closes the connections to all bastions and to the ssh-agent
+func (cfg *tunnelConfig) Close() error {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	for id, t := range cfg.bastions {
+		t.mu.Lock()
+		if t.client != nil {
+			t.client.Close()
+		}
+		t.mu.Unlock()
+		delete(cfg.bastions, id)
+	}
+	if cfg.agentConn != nil {
+		cfg.agentConn.Close()
+		cfg.sshAgent, cfg.agentConn = nil, nil
+	}
+	return nil
+}
+
+// closeBastion closes the connection to the bastion, the next connection through it dials it again
+func (cfg *tunnelConfig) closeBastion(id string) {
+	cfg.mu.Lock()
+	t, ok := cfg.bastions[id]
+	delete(cfg.bastions, id)
+	cfg.mu.Unlock()
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		t.client.Close()
+	}
+}
+
+// loginUser is the user that is tried first when logging in to the instance
+func (cfg *tunnelConfig) loginUser(i *instance) string {
+	if cfg.InstanceUser != "" {
+		return cfg.InstanceUser
+	}
+	if cfg.LoginUsers != nil {
+		return cfg.LoginUsers.Users(i)[0]
+	}
+	return UbuntuUser
+}
+
+// loadIdentities sets the Agent from Identities the first time it is called
+func (cfg *tunnelConfig) loadIdentities() error {
+	cfg.identitiesOnce.Do(func() {
+		if cfg.Identities == nil {
+			return
+		}
+		a, err := cfg.Identities()
+		if a != nil {
+			cfg.Agent = a
+		}
+		cfg.identitiesErr = err
+	})
+	return cfg.identitiesErr
+}
+
+func (cfg *tunnelConfig) agent() (agent.Agent, error) {
+	if err := cfg.loadIdentities(); err != nil {
 		return nil, err
 	}
+	if cfg.Agent != nil {
+		return cfg.Agent, nil
+	}
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if cfg.sshAgent == nil {
+		conn, err := dialSSHAgent()
+		if err != nil {
+			return nil, err
+		}
+		cfg.sshAgent, cfg.agentConn = agent.NewClient(conn), conn
+	}
+	return cfg.sshAgent, nil
+}
 
-	signers, err := agentClient.Signers()
+// hopSigners returns the signers to offer to the host, with the key that last logged in to the hop first
+func (cfg *tunnelConfig) hopSigners(a agent.Agent, signers []ssh.Signer, host *instance, selectors []string, user, hop string) ([]ssh.Signer, []string, error) {
+	signers, err := selectSigners(a, signers, hostKeySelectors(host, selectors))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", host.Name, err)
+	}
+	signers, problems := authSigners(signers, user)
+	if cfg.LastKeys != nil {
+		signers = cfg.LastKeys.Order(hopKey(host, hop), signers)
+	}
+	return signers, problems, nil
+}
+
+// hostKeyCallback returns the callback that verifies the host key of the bastion or instance
+func (cfg *tunnelConfig) hostKeyCallback(i *instance) ssh.HostKeyCallback {
+	if cfg.HostKeys == nil {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return cfg.HostKeys.Callback(i.ID)
+}
+
+// loginError is the instance refusing to let the user in, unlike other errors another user may get in
+type loginError struct {
+	err error
+}
+
+func (e *loginError) Error() string { return e.err.Error() }
+
+func (e *loginError) Unwrap() error { return e.err }
+
+func newTunnelledSSHClient(cfg *tunnelConfig, pair *instancePair, instanceUser string) (*sshForwardingClient, error) {
+	fmt.Printf("[+] trying %s@%s via %s@%s\n", instanceUser, pair.Instance.PrivateIP, cfg.BastionUser, pair.Bastion.PublicIP)
+	instanceAddress := maybeAddDefaultPort(pair.Instance.PrivateIP)
+
+	tunnelClient, signers, err := cfg.tunnel(pair.Bastion)
+	if err != nil {
+		return nil, err
+	}
+	agentClient, err := cfg.agent()
+	if err != nil {
+		return nil, err
+	}
+	instanceSigners, problems, err := cfg.hopSigners(agentClient, signers, pair.Instance, cfg.InstanceKeys, instanceUser, "instance")
 	if err != nil {
 		return nil, err
 	}
 
+	targetConn, err := dialThroughBastion(tunnelClient, instanceAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceConfig := &ssh.ClientConfig{
+		User: instanceUser,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(instanceSigners...),
+		},
+		HostKeyCallback: cfg.hostKeyCallback(pair.Instance),
+	}
+	instanceConfig.User = instanceUser
+	conn, chans, reqs, err := ssh.NewClientConn(targetConn, instanceAddress, instanceConfig)
+	if err != nil {
+		targetConn.Close()
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, &loginError{authError(err, problems)}
+		}
+		return nil, authError(err, problems)
+	}
+	client := ssh.NewClient(conn, chans, reqs)
+	forwarded, err := cfg.Forwarding.agentFor(agentClient, pair.Instance)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return newSSHForwardingClient(client, forwarded)
+}
+
+// dialBastion opens a SSH connection to the bastion using the keys from the agent and the configured certificates.
+// It returns all signers so that they can be reused for the next hop.
+func dialBastion(cfg *tunnelConfig, bastion *instance) (*ssh.Client, []ssh.Signer, error) {
+	agentClient, err := cfg.agent()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signers, err := agentClient.Signers()
+	if err != nil {
+		return nil, nil, err
+	}
+	signers, err = userCertSigners(cfg.CertFiles, signers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bastionSigners, problems, err := cfg.hopSigners(agentClient, signers, bastion, cfg.BastionKeys, cfg.BastionUser, "bastion")
+	if err != nil {
+		return nil, nil, err
+	}
 	clientConfig := &ssh.ClientConfig{
-		User: bastionUser,
+		User: cfg.BastionUser,
 		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signers...),
+			ssh.PublicKeys(bastionSigners...),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: cfg.hostKeyCallback(bastion),
 	}
 
 	var tunnelClient *ssh.Client
 	dialFunc := func(echan chan error) {
 		var err error
-		tunnelClient, err = ssh.Dial("tcp", bastionAddress, clientConfig)
+		tunnelClient, err = ssh.Dial("tcp", maybeAddDefaultPort(bastion.PublicIP), clientConfig)
 		echan <- err
 	}
 	if err = timeoutSSHDial(dialFunc); err != nil {
-		return nil, err
+		return nil, nil, authError(err, problems)
 	}
+	return tunnelClient, signers, nil
+}
 
+// dialThroughBastion opens a TCP connection from the bastion to the address
+func dialThroughBastion(tunnelClient *ssh.Client, address string) (net.Conn, error) {
 	var targetConn net.Conn
-	dialFunc = func(echan chan error) {
-		tgtTCPAddr, err := net.ResolveTCPAddr("tcp", instanceAddress)
+	dialFunc := func(echan chan error) {
+		tgtTCPAddr, err := net.ResolveTCPAddr("tcp", address)
 		if err != nil {
 			echan <- err
 			return
@@ -56,37 +300,28 @@ func newTunnelledSSHClient(bastionUser, instanceUser, bastionAddress, instanceAd
 		targetConn, err = tunnelClient.DialTCP("tcp", nil, tgtTCPAddr)
 		echan <- err
 	}
-	if err = timeoutSSHDial(dialFunc); err != nil {
+	if err := timeoutSSHDial(dialFunc); err != nil {
 		return nil, err
 	}
+	return targetConn, nil
+}
 
-	instanceConfig := &ssh.ClientConfig{
-		User: instanceUser,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signers...),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	instanceConfig.User = instanceUser
-	conn, chans, reqs, err := ssh.NewClientConn(targetConn, instanceAddress, instanceConfig)
+func sshAgentClient() (agent.Agent, error) {
+	agt, err := dialSSHAgent()
 	if err != nil {
 		return nil, err
 	}
-	return newSSHForwardingClient(ssh.NewClient(conn, chans, reqs))
+
+	return agent.NewClient(agt), nil
 }
 
-func sshAgentClient() (agent.Agent, error) {
+// dialSSHAgent connects to the ssh-agent at SSH_AUTH_SOCK
+func dialSSHAgent() (net.Conn, error) {
 	sock := os.Getenv("SSH_AUTH_SOCK")
 	if sock == "" {
-		return nil, errors.New("SSH_AUTH_SOCK environment variable is not set, verify that ssh-agent is running")
+		return nil, errors.New("SSH_AUTH_SOCK environment variable is not set, verify that ssh-agent is running or use -i")
 	}
-
-	agt, err := net.Dial("unix", sock)
-	if err != nil {
-		return nil, err
-	}
-
-	return agent.NewClient(agt), nil
+	return net.Dial("unix", sock)
 }
 
 func maybeAddDefaultPort(addr string) string {
@@ -96,13 +331,12 @@ func maybeAddDefaultPort(addr string) string {
 	return net.JoinHostPort(addr, strconv.Itoa(22))
 }
 
-func newSSHForwardingClient(client *ssh.Client) (*sshForwardingClient, error) {
-	a, err := sshAgentClient()
-	if err != nil {
-		return nil, err
+// newSSHForwardingClient wraps the client and forwards the agent to it, if there is one
+func newSSHForwardingClient(client *ssh.Client, a agent.Agent) (*sshForwardingClient, error) {
+	if a == nil {
+		return &sshForwardingClient{false, client, false}, nil
 	}
-
-	err = agent.ForwardToAgent(client, a)
+	err := agent.ForwardToAgent(client, a)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"os"
 
 	"golang.org/x/crypto/ssh"
@@ -42,6 +43,23 @@ func Shell(client *sshForwardingClient) error {
 	return nil
 }
 
+// Exec runs a command on the given client and waits for it to finish. The remote stdout and stderr are written to
+// the given writers. It returns an *ssh.ExitError if the command exited with a non-zero status.
+func Exec(client *sshForwardingClient, command string, stdout, stderr io.Writer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if err = client.ForwardAgentAuthentication(session); err != nil {
+		return err
+	}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return session.Run(command)
+}
+
 // makeSession initializes a ssh.Session connected to the invoking process's stdout/stderr/stdout.
 // If the invoking session is a terminal, a TTY will be requested for the SSH session.
 // It returns a ssh.Session, a finalizing function used to clean up after the session terminates,
@@ -74,7 +92,12 @@ func makeSession(client *sshForwardingClient) (session *ssh.Session, finalize fu
 			return
 		}
 
+		// prompts during the session, e.g. to confirm agent signing requests, read their answer from the forwarder
+		input := &stdinForwarder{r: os.Stdin}
+		session.Stdin = input
+		setShellInput(input)
 		finalize = func() {
+			setShellInput(nil)
 			session.Close()
 			terminal.Restore(fd, oldState)
 		}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testSSHServer serves SSH on a local port until the test ends and hands every connection to handle, config defaults
+// to accepting any client. It returns the listener and a count of the accepted connections, including those that fail
+// to authenticate.
+func testSSHServer(t *testing.T, config *ssh.ServerConfig, handle func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request)) (net.Listener, func() int) {
+	if config == nil {
+		config = &ssh.ServerConfig{NoClientAuth: true}
+	}
+	config.AddHostKey(testSigner(t))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var mu sync.Mutex
+	conns := 0
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns++
+			mu.Unlock()
+			go func() {
+				serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				handle(serverConn, chans, reqs)
+			}()
+		}
+	}()
+	return l, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns
+	}
+}
+
+// testSSHClient connects to a testSSHServer
+func testSSHClient(t *testing.T, l net.Listener) *ssh.Client {
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "admin",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// bastionServer is a SSH server that accepts the key and counts the connections to it
+func bastionServer(t *testing.T, key ssh.PublicKey) (net.Listener, func() int) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if !containsKey([]ssh.PublicKey{key}, k) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	return testSSHServer(t, config, func(_ *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		for newChannel := range chans {
+			newChannel.Reject(ssh.Prohibited, "no channels")
+		}
+	})
+}
+
+// agentServer serves the keyring at a unix socket and counts the connections to it
+func agentServer(t *testing.T, dir string, keyring agent.Agent) (net.Listener, func() int, chan struct{}) {
+	l, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	conns := 0
+	closed := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns++
+			mu.Unlock()
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return l, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns
+	}, closed
+}
+
+func TestTunnelSharesBastionConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentListener, agentConns, agentClosed := agentServer(t, dir, keyring)
+	defer agentListener.Close()
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", agentListener.Addr().String())
+	l, bastionConns := bastionServer(t, signer.PublicKey())
+	defer l.Close()
+
+	cfg := &tunnelConfig{BastionUser: "ubuntu"}
+	bastion := &instance{ID: "i-bastion", Name: "bastion", PublicIP: l.Addr().String()}
+	first, signers, err := cfg.tunnel(bastion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 {
+		t.Errorf("Expected the signer from the agent, got %d signers", len(signers))
+	}
+	second, _, err := cfg.tunnel(bastion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first || bastionConns() != 1 {
+		t.Errorf("Expected the connection to the bastion to be shared, got %d connections", bastionConns())
+	}
+
+	// a lost connection is dialed again
+	cfg.mu.Lock()
+	closed := cfg.bastions[bastion.ID].closed
+	cfg.mu.Unlock()
+	first.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to the bastion to be closed")
+	}
+	third, _, err := cfg.tunnel(bastion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first || bastionConns() != 2 {
+		t.Errorf("Expected the bastion to be dialed again, got %d connections", bastionConns())
+	}
+
+	cfg.closeBastion(bastion.ID)
+	if _, _, err := cfg.tunnel(bastion); err != nil {
+		t.Fatal(err)
+	}
+	if bastionConns() != 3 {
+		t.Errorf("Expected a closed bastion to be dialed again, got %d connections", bastionConns())
+	}
+	if agentConns() != 1 {
+		t.Errorf("Expected the ssh-agent to be dialed once, got %d connections", agentConns())
+	}
+
+	cfg.Close()
+	select {
+	case <-agentClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to the ssh-agent to be closed")
+	}
+	if len(cfg.bastions) != 0 {
+		t.Errorf("Expected the bastions to be closed, got %d", len(cfg.bastions))
+	}
+}
+
+func TestTunnelLoadsIdentitiesOnce(t *testing.T) {
+	calls := 0
+	cfg := &tunnelConfig{Identities: func() (agent.Agent, error) {
+		calls++
+		return nil, errors.New("bad passphrase")
+	}}
+	if calls != 0 {
+		t.Errorf("Expected the identities not to be loaded before they are needed")
+	}
+	for n := 0; n < 2; n++ {
+		if _, err := cfg.agent(); err == nil || err.Error() != "bad passphrase" {
+			t.Errorf("Expected the error loading the identities, got %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the identities to be loaded once, got %d", calls)
+	}
+}
+
+func TestConnectAsStopsAtTheBastion(t *testing.T) {
+	l, bastionConns := bastionServer(t, testSigner(t).PublicKey())
+	defer l.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tunnelConfig{BastionUser: "ubuntu", Agent: keyring}
+	pair := &instancePair{
+		Bastion:  &instance{ID: "i-bastion", Name: "bastion", PublicIP: l.Addr().String()},
+		Instance: &instance{ID: "i-web", Name: "web", PrivateIP: "10.0.0.1"},
+	}
+	if _, _, err := connectAs(pair, cfg, ""); err == nil {
+		t.Fatal("Expected the bastion to refuse the key")
+	}
+	if bastionConns() != 1 {
+		t.Errorf("Expected the bastion to be dialed once, not for each user, got %d connections", bastionConns())
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	sshConfigBegin = "# BEGIN salio managed block"
+	sshConfigEnd   = "# END salio managed block"
+)
+
+// defaultSSHConfigPath is the file written by ssh-config, include it from ~/.ssh/config with "Include salio_config"
+func defaultSSHConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "salio_config"
+	}
+	return filepath.Join(home, ".ssh", "salio_config")
+}
+
+// sshConfigBlock renders one Host block per instance. Instances are aliased by ID and, when a name is shared by
+// several instances, the name is given to the newest one. Bastions are reached directly on their public IP and
+// everything else through a ProxyJump via its first bastion, logging in as the user loginUser picks for the instance.
+func sshConfigBlock(instances []*instance, bastionUser string, loginUser func(*instance) string) string {
+	sorted := make([]*instance, len(instances))
+	copy(sorted, instances)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		if sorted[i].LaunchTime != nil && sorted[j].LaunchTime != nil && !sorted[i].LaunchTime.Equal(*sorted[j].LaunchTime) {
+			return sorted[i].LaunchTime.After(*sorted[j].LaunchTime)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, sshConfigBegin)
+	fmt.Fprintln(&buf, "# generated by salio, changes between these markers will be overwritten")
+	named := make(map[string]bool)
+	for _, i := range sorted {
+		aliases := []string{i.ID}
+		if i.Name != "" && !strings.ContainsAny(i.Name, " \t*?!") && !named[i.Name] {
+			named[i.Name] = true
+			aliases = append([]string{i.Name}, aliases...)
+		}
+
+		if i.IsNat {
+			if i.PublicIP == "" {
+				continue
+			}
+			fmt.Fprintf(&buf, "\nHost %s\n", strings.Join(aliases, " "))
+			fmt.Fprintf(&buf, "    HostName %s\n", i.PublicIP)
+			fmt.Fprintf(&buf, "    User %s\n", bastionUser)
+			continue
+		}
+
+		bastion := firstBastion(i)
+		if bastion == nil || i.PrivateIP == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, "\nHost %s\n", strings.Join(aliases, " "))
+		fmt.Fprintf(&buf, "    HostName %s\n", i.PrivateIP)
+		fmt.Fprintf(&buf, "    User %s\n", loginUser(i))
+		fmt.Fprintf(&buf, "    ProxyJump %s@%s\n", bastionUser, bastion.PublicIP)
+	}
+	fmt.Fprintln(&buf, sshConfigEnd)
+	return buf.String()
+}
+
+// firstBastion returns the bastion with the lowest ID so that the generated config is stable between runs
+func firstBastion(i *instance) *instance {
+	var first *instance
+	for _, b := range i.Bastions {
+		if b.PublicIP == "" {
+			continue
+		}
+		if first == nil || b.ID < first.ID {
+			first = b
+		}
+	}
+	return first
+}
+
+// replaceManagedBlock swaps the managed block in the existing content for the new one, or appends it if there is none
+func replaceManagedBlock(existing, block string) string {
+	start := strings.Index(existing, sshConfigBegin)
+	end := strings.Index(existing, sshConfigEnd)
+	if start < 0 || end < start {
+		if existing != "" && !strings.HasSuffix(existing, "\n") {
+			existing += "\n"
+		}
+		if existing != "" {
+			existing += "\n"
+		}
+		return existing + block
+	}
+	end += len(sshConfigEnd)
+	if end < len(existing) && existing[end] == '\n' {
+		end++
+	}
+	return existing[:start] + block + existing[end:]
+}
+
+// lineDiff returns the lines removed from a and added in b, prefixed with "-" and "+", based on the longest common
+// subsequence of lines
+func lineDiff(a, b string) []string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	if a == "" {
+		x = nil
+	}
+
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			i++
+			j++
+		case j < len(y) && (i == len(x) || lcs[i][j+1] >= lcs[i+1][j]):
+			diff = append(diff, "+"+y[j])
+			j++
+		default:
+			diff = append(diff, "-"+x[i])
+			i++
+		}
+	}
+	return diff
+}
+
+// writeSSHConfig shows the changes to the managed block in the file and writes them after confirmation
+func writeSSHConfig(file, block string, confirm bool) error {
+	existing, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	updated := replaceManagedBlock(string(existing), block)
+
+	diff := lineDiff(string(existing), updated)
+	if len(diff) == 0 {
+		fmt.Printf("[+] %s is up to date\n", file)
+		return nil
+	}
+	for _, line := range diff {
+		fmt.Println(line)
+	}
+
+	if confirm {
+		fmt.Printf("[?] Write %d changed line(s) to %s? [y/N] ", len(diff), file)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			fmt.Println("[!] nothing written")
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, []byte(updated), 0600); err != nil {
+		return err
+	}
+	fmt.Printf("[+] wrote %s\n", file)
+	return nil
+}
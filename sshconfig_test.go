@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestReplaceManagedBlock(t *testing.T) {
+	block := sshConfigBegin + "\nHost new\n" + sshConfigEnd + "\n"
+
+	existing := "Host mine\n    User me\n\n" + sshConfigBegin + "\nHost old\n" + sshConfigEnd + "\n\nHost other\n"
+	expected := "Host mine\n    User me\n\n" + block + "\nHost other\n"
+	if actual := replaceManagedBlock(existing, block); actual != expected {
+		t.Errorf("Expected managed block to be replaced, got %q", actual)
+	}
+
+	if actual := replaceManagedBlock("Host mine", block); !strings.HasPrefix(actual, "Host mine\n\n") || !strings.HasSuffix(actual, block) {
+		t.Errorf("Expected managed block to be appended, got %q", actual)
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	diff := lineDiff("a\nb\nc\n", "a\nc\nd\n")
+	expected := []string{"-b", "+d"}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Expected diff %v, got %v", expected, diff)
+	}
+
+	if diff := lineDiff("a\n", "a\n"); len(diff) != 0 {
+		t.Errorf("Expected no diff, got %v", diff)
+	}
+}
+
+func TestSSHConfigBlockUsers(t *testing.T) {
+	bastion := &instance{ID: "i-bastion", Name: "web.bastion", IsNat: true, PublicIP: "1.2.3.4"}
+	tagged := &instance{ID: "i-1", Name: "web.app", PrivateIP: "10.0.0.5", Tags: map[string]string{userTag: "deploy"}, Bastions: []*instance{bastion}}
+	plain := &instance{ID: "i-2", Name: "web.worker", PrivateIP: "10.0.0.6", Bastions: []*instance{bastion}}
+	instances := []*instance{bastion, tagged, plain}
+
+	cfg := &tunnelConfig{LoginUsers: &loginUsers{images: make(map[string]*ec2.Image), worked: make(map[string]string)}}
+	block := sshConfigBlock(instances, "ubuntu", cfg.loginUser)
+	for _, expected := range []string{
+		"Host web.app i-1\n    HostName 10.0.0.5\n    User deploy\n",
+		"Host web.worker i-2\n    HostName 10.0.0.6\n    User ubuntu\n",
+	} {
+		if !strings.Contains(block, expected) {
+			t.Errorf("Expected the block to contain %q, got %s", expected, block)
+		}
+	}
+
+	cfg.InstanceUser = "root"
+	if block := sshConfigBlock(instances, "ubuntu", cfg.loginUser); strings.Count(block, "User root\n") != 2 {
+		t.Errorf("Expected -instance-user to override the users of all instances, got %s", block)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// ttyMu serialises prompts from concurrent connections
+var ttyMu sync.Mutex
+
+// errNoTerminal is returned when there is no terminal to prompt on, e.g. in a background process
+var errNoTerminal = errors.New("no terminal available to ask for input")
+
+// openTTY opens the controlling terminal. Prompts go to the terminal rather than stdin and stdout, which may be
+// carrying a proxied connection or machine readable output.
+func openTTY() (*os.File, error) {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	tty, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errNoTerminal
+	}
+	return tty, nil
+}
+
+// confirm asks a yes/no question on the terminal and reports whether the answer was yes
+func confirm(question string) (bool, error) {
+	ttyMu.Lock()
+	defer ttyMu.Unlock()
+
+	var answer string
+	if input := currentShellInput(); input != nil {
+		// the terminal is in raw mode, so lines need a carriage return and the answer is echoed here
+		fmt.Fprintf(os.Stderr, "\r\n%s (yes/no): ", question)
+		line, err := input.readLine(os.Stderr)
+		fmt.Fprint(os.Stderr, "\r\n")
+		if err != nil {
+			return false, err
+		}
+		answer = line
+	} else {
+		tty, err := openTTY()
+		if err != nil {
+			return false, err
+		}
+		defer tty.Close()
+
+		fmt.Fprintf(os.Stderr, "%s (yes/no): ", question)
+		if answer, err = readLine(tty); err != nil {
+			return false, err
+		}
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "yes" || answer == "y", nil
+}
+
+var (
+	shellInputMu sync.Mutex
+	shellInput   *stdinForwarder
+)
+
+// setShellInput records the forwarder of the running shell session, or nil once it ends
+func setShellInput(f *stdinForwarder) {
+	shellInputMu.Lock()
+	defer shellInputMu.Unlock()
+	shellInput = f
+}
+
+func currentShellInput() *stdinForwarder {
+	shellInputMu.Lock()
+	defer shellInputMu.Unlock()
+	return shellInput
+}
+
+// stdinForwarder is the stdin of an interactive shell session. It is the only reader of the terminal while the
+// session runs, and hands the input to a prompt instead of the instance while one is waiting for an answer.
+type stdinForwarder struct {
+	r      io.Reader
+	mu     sync.Mutex
+	prompt *promptInput
+}
+
+// promptInput receives the terminal input until the prompt is done
+type promptInput struct {
+	data chan []byte
+	done chan struct{}
+}
+
+func (f *stdinForwarder) Read(b []byte) (int, error) {
+	for {
+		n, err := f.r.Read(b)
+		f.mu.Lock()
+		p := f.prompt
+		f.mu.Unlock()
+		if p == nil || n == 0 {
+			return n, err
+		}
+		select {
+		case p.data <- append([]byte(nil), b[:n]...):
+			if err != nil {
+				return 0, err
+			}
+		case <-p.done:
+			return n, err
+		}
+	}
+}
+
+// readLine reads a line typed while the terminal is in raw mode, echoing it to w. Ctrl-C and Ctrl-D give an empty
+// answer, input after the end of the line is dropped.
+func (f *stdinForwarder) readLine(w io.Writer) (string, error) {
+	p := &promptInput{data: make(chan []byte), done: make(chan struct{})}
+	f.mu.Lock()
+	f.prompt = p
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.prompt = nil
+		f.mu.Unlock()
+		close(p.done)
+	}()
+
+	var line []byte
+	for data := range p.data {
+		for _, b := range data {
+			switch b {
+			case '\r', '\n':
+				return string(line), nil
+			case 3, 4:
+				return "", nil
+			case 8, 127:
+				if len(line) > 0 {
+					line = line[:len(line)-1]
+					fmt.Fprint(w, "\b \b")
+				}
+			default:
+				line = append(line, b)
+				w.Write([]byte{b})
+			}
+		}
+	}
+	return string(line), nil
+}
+
+// readLine reads up to the end of the line. The terminal may be in raw mode during a shell session, in which case the
+// line ends with a carriage return instead of a newline.
+func readLine(tty *os.File) (string, error) {
+	r := bufio.NewReader(tty)
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return string(line), err
+		}
+		if b == '\n' || b == '\r' {
+			return string(line), nil
+		}
+		line = append(line, b)
+	}
+}
+
+// readPassword asks for a secret on the terminal without echoing it
+func readPassword(prompt string) ([]byte, error) {
+	ttyMu.Lock()
+	defer ttyMu.Unlock()
+
+	tty, err := openTTY()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return password, err
+}
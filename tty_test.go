@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStdinForwarderPrompt(t *testing.T) {
+	r, w := io.Pipe()
+	f := &stdinForwarder{r: r}
+	shell := make(chan string)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				close(shell)
+				return
+			}
+			shell <- string(buf[:n])
+		}
+	}()
+
+	w.Write([]byte("ls\r"))
+	if got := <-shell; got != "ls\r" {
+		t.Errorf("Expected the shell to get the input, got %q", got)
+	}
+
+	var echo bytes.Buffer
+	answer := make(chan string)
+	go func() {
+		line, _ := f.readLine(&echo)
+		answer <- line
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		f.mu.Lock()
+		waiting := f.prompt != nil
+		f.mu.Unlock()
+		if waiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the prompt to wait for input")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w.Write([]byte("yez\x7fs\rdropped"))
+	if got := <-answer; got != "yes" {
+		t.Errorf("Expected the prompt to get the answer, got %q", got)
+	}
+	if echo.String() != "yez\b \bs" {
+		t.Errorf("Expected the answer to be echoed, got %q", echo.String())
+	}
+
+	w.Write([]byte("exit\r"))
+	if got := <-shell; got != "exit\r" {
+		t.Errorf("Expected the shell to get the input after the prompt, got %q", got)
+	}
+	w.Close()
+	<-shell
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Delays between reconnection attempts of a detached tunnel
+const (
+	tunnelMinBackoff = time.Second
+	tunnelMaxBackoff = time.Minute
+)
+
+// tunnelState is the record of a detached tunnel, written to the tunnels directory by the process running it
+type tunnelState struct {
+	ID       string
+	Target   string
+	Name     string
+	Forwards string
+	// Args are the global flags the tunnel was started with, used to run it again on restart
+	Args    []string
+	PID     int
+	Started time.Time
+	Status  string
+}
+
+// defaultTunnelsDir is where the state and logs of detached tunnels are kept
+func defaultTunnelsDir() (string, error) {
+	dir, err := runtimeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tunnels"), nil
+}
+
+func tunnelFile(dir, id string) string {
+	return filepath.Join(dir, id+".json")
+}
+
+func tunnelLogFile(dir, id string) string {
+	return filepath.Join(dir, id+".log")
+}
+
+func tunnelLockFile(dir, id string) string {
+	return filepath.Join(dir, id+".lock")
+}
+
+// lockTunnel takes the lock that the process running the tunnel holds until it exits
+func lockTunnel(dir, id string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(tunnelLockFile(dir, id), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// other processes take the lock for a moment to check whether the tunnel is running
+	for attempt := 0; attempt < 10; attempt++ {
+		if err = lockFile(f); err == nil {
+			return f, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	f.Close()
+	return nil, fmt.Errorf("tunnel %s is already running", id)
+}
+
+func (s *tunnelState) save(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write and rename so that a listing never sees a partial file
+	tmp := tunnelFile(dir, s.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, tunnelFile(dir, s.ID))
+}
+
+func loadTunnel(dir, id string) (*tunnelState, error) {
+	data, err := ioutil.ReadFile(tunnelFile(dir, id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no tunnel %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s tunnelState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %s", tunnelFile(dir, id), err)
+	}
+	return &s, nil
+}
+
+// loadTunnels returns all recorded tunnels, oldest first
+func loadTunnels(dir string) ([]*tunnelState, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var tunnels []*tunnelState
+	for _, f := range files {
+		s, err := loadTunnel(dir, strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[!] %s\n", err)
+			continue
+		}
+		tunnels = append(tunnels, s)
+	}
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Started.Before(tunnels[j].Started) })
+	return tunnels, nil
+}
+
+// findTunnels returns the tunnels with the tunnel ID, instance ID or instance name, or all of them
+func findTunnels(dir, target string) ([]*tunnelState, error) {
+	tunnels, err := loadTunnels(dir)
+	if err != nil {
+		return nil, err
+	}
+	var found []*tunnelState
+	for _, t := range tunnels {
+		if target == "all" || target == t.ID || target == t.Target || target == t.Name {
+			found = append(found, t)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no tunnel matches %s", target)
+	}
+	return found, nil
+}
+
+// Running reports whether a process is running the tunnel, i.e. holds the lock of the tunnel
+func (s *tunnelState) Running(dir string) bool {
+	f, err := os.OpenFile(tunnelLockFile(dir, s.ID), os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return lockFile(f) != nil
+}
+
+func newTunnelID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tunnelArgs are the global flags of this invocation to run a detached tunnel with. The AWS profile and region are
+// included even when they came from the environment, so that a restart from another shell uses the same account.
+func tunnelArgs() []string {
+	args := passthroughFlags("detach", "N", "auto-jump")
+	visited := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { visited[f.Name] = true })
+	if !visited["p"] && os.Getenv("AWS_PROFILE") != "" {
+		args = append(args, "-p", os.Getenv("AWS_PROFILE"))
+	}
+	if !visited["r"] && os.Getenv("AWS_REGION") != "" {
+		args = append(args, "-r", os.Getenv("AWS_REGION"))
+	}
+	return args
+}
+
+// startDetachedTunnel records a tunnel to the instance and runs it in the background
+func startDetachedTunnel(dir string, pair *instancePair, forwards *forwardSet) error {
+	s := &tunnelState{
+		ID:       newTunnelID(),
+		Target:   pair.Instance.ID,
+		Name:     pair.Instance.Name,
+		Forwards: forwards.String(),
+		Args:     tunnelArgs(),
+		Started:  time.Now(),
+		Status:   "starting",
+	}
+	if err := spawnTunnel(dir, s); err != nil {
+		return err
+	}
+	fmt.Printf("[+] started tunnel %s to %s (%s): %s, pid %d\n", s.ID, s.Name, s.Target, s.Forwards, s.PID)
+	fmt.Printf("[+] logging to %s, stop it with: salio tunnels stop %s\n", tunnelLogFile(dir, s.ID), s.ID)
+	return nil
+}
+
+// spawnTunnel starts "salio tunnels run <id>" in the background for the recorded tunnel and waits for it to connect
+func spawnTunnel(dir string, s *tunnelState) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// the process records its own PID once it holds the lock of the tunnel
+	s.PID = 0
+	if err := s.save(dir); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(tunnelLogFile(dir, s.ID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, append(append([]string{}, s.Args...), "tunnels", "run", s.ID)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	detach(cmd)
+	if err := startWithKeys(cmd); err != nil {
+		return err
+	}
+	s.PID = cmd.Process.Pid
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	return waitForTunnel(dir, s, exited)
+}
+
+// waitForTunnel waits until the tunnel has connected for the first time. It fails if the process running it exits,
+// e.g. because it can't authenticate.
+func waitForTunnel(dir string, s *tunnelState, exited <-chan struct{}) error {
+	timeout := time.After(15 * time.Second)
+	for {
+		select {
+		case <-exited:
+			if current, err := loadTunnel(dir, s.ID); err == nil && strings.HasPrefix(current.Status, "failed") {
+				return fmt.Errorf("tunnel %s %s", s.ID, current.Status)
+			}
+			return fmt.Errorf("tunnel %s exited, see %s", s.ID, tunnelLogFile(dir, s.ID))
+		case <-timeout:
+			fmt.Printf("[!] tunnel %s has not connected yet, check on it with: salio tunnels list\n", s.ID)
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+		if current, err := loadTunnel(dir, s.ID); err == nil && strings.HasPrefix(current.Status, "connected") {
+			return nil
+		}
+	}
+}
+
+// stopTunnel terminates the process running the tunnel and waits for it to exit
+func stopTunnel(dir string, s *tunnelState) error {
+	if !s.Running(dir) {
+		return nil
+	}
+	// the PID was recorded by the process holding the lock, so it can't belong to another process
+	if s.PID <= 0 {
+		return fmt.Errorf("tunnel %s is starting, try again", s.ID)
+	}
+	if err := terminate(s.PID); err != nil {
+		return err
+	}
+	for wait := 0; wait < 50; wait++ {
+		if !s.Running(dir) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("tunnel %s (pid %d) did not exit", s.ID, s.PID)
+}
+
+// authFailed reports whether the connection failed in a way that reconnecting won't fix, such as keys that aren't
+// accepted or a host key that has to be confirmed on a terminal
+func authFailed(err error) bool {
+	return strings.Contains(err.Error(), "unable to authenticate") || strings.Contains(err.Error(), errNoTerminal.Error())
+}
+
+// nextBackoff doubles the delay before the next reconnection attempt up to the maximum
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > tunnelMaxBackoff {
+		d = tunnelMaxBackoff
+	}
+	return d
+}
+
+// tunnelRunner keeps a detached tunnel connected, reconnecting with backoff whenever the connection is lost
+type tunnelRunner struct {
+	Dir      string
+	State    *tunnelState
+	Forwards *forwardSet
+
+	resolve func(s *tunnelState) (*instancePair, error)
+	connect func(pair *instancePair) (*sshForwardingClient, error)
+
+	mu      sync.Mutex
+	client  *sshForwardingClient
+	stopped chan struct{}
+}
+
+func (r *tunnelRunner) status(format string, a ...interface{}) {
+	r.State.Status = strings.Replace(fmt.Sprintf(format, a...), "\n", " ", -1)
+	fmt.Printf("%s [+] %s\n", time.Now().Format("2006-01-02 15:04:05"), r.State.Status)
+	if err := r.State.save(r.Dir); err != nil {
+		fmt.Printf("[!] %s\n", err)
+	}
+}
+
+// Run connects and serves the forwards until Stop is called
+func (r *tunnelRunner) Run() {
+	r.status("connecting")
+	backoff := tunnelMinBackoff
+	for {
+		connected := time.Now()
+		err := r.serve()
+		select {
+		case <-r.stopped:
+			return
+		default:
+		}
+		if authFailed(err) {
+			r.status("failed: %s", err)
+			return
+		}
+		// a connection that held for a while starts over with short delays
+		if time.Since(connected) > tunnelMaxBackoff {
+			backoff = tunnelMinBackoff
+		}
+		r.status("reconnecting in %s: %s", backoff, err)
+		select {
+		case <-r.stopped:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// serve connects once and returns when the connection is lost
+func (r *tunnelRunner) serve() error {
+	pair, err := r.resolve(r.State)
+	if err != nil {
+		return err
+	}
+	client, err := r.connect(pair)
+	if err != nil {
+		return err
+	}
+	listeners, err := r.Forwards.Start(client)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	defer closeAll(listeners)
+
+	r.mu.Lock()
+	r.client = client
+	r.mu.Unlock()
+	select {
+	case <-r.stopped:
+		client.Close()
+	default:
+	}
+
+	r.status("connected to %s via %s since %s", pair.Instance.PrivateIP, pair.Bastion.PublicIP, time.Now().Format("2006-01-02 15:04"))
+	client.Wait()
+	return errors.New("connection lost")
+}
+
+// Stop closes the connection and ends Run
+func (r *tunnelRunner) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	close(r.stopped)
+	if r.client != nil {
+		r.client.Close()
+	}
+}
+
+// resolveTunnelTarget finds the instance of the tunnel by ID, or by name if it has been replaced
+func resolveTunnelTarget(config *aws.Config, s *tunnelState) (*instancePair, error) {
+	instances, err := fetchInstances(config)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := resolveProxyTarget(s.Target, instances)
+	if err != nil && s.Name != "" {
+		pair, err = resolveProxyTarget(s.Name, instances)
+	}
+	return pair, err
+}
+
+// tunnelsCommand runs one of the tunnels subcommands: list, stop <tunnel|all>, restart <tunnel|all> or run <id>
+func tunnelsCommand(cfg *tunnelConfig, config *aws.Config, forwards *forwardSet, command string, args []string) error {
+	dir, err := defaultTunnelsDir()
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "list":
+		tunnels, err := loadTunnels(dir)
+		if err != nil {
+			return err
+		}
+		printTunnels(os.Stdout, dir, tunnels)
+		return nil
+	case "stop", "restart":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: salio tunnels %s <tunnel id, instance id or name|all>", command)
+		}
+		tunnels, err := findTunnels(dir, args[0])
+		if err != nil {
+			return err
+		}
+		// restarted tunnels are handed the keys, so passphrases are asked for now
+		if command == "restart" {
+			if err := cfg.loadIdentities(); err != nil {
+				return err
+			}
+		}
+		for _, t := range tunnels {
+			if err := stopTunnel(dir, t); err != nil {
+				return err
+			}
+			if command == "stop" {
+				os.Remove(tunnelFile(dir, t.ID))
+				os.Remove(tunnelLogFile(dir, t.ID))
+				os.Remove(tunnelLockFile(dir, t.ID))
+				fmt.Printf("[+] stopped tunnel %s to %s\n", t.ID, t.Name)
+				continue
+			}
+			t.Started = time.Now()
+			t.Status = "starting"
+			if err := spawnTunnel(dir, t); err != nil {
+				return err
+			}
+			fmt.Printf("[+] restarted tunnel %s to %s, pid %d\n", t.ID, t.Name, t.PID)
+		}
+		return nil
+	case "run":
+		if len(args) != 1 {
+			return errors.New("usage: salio tunnels run <tunnel id>")
+		}
+		s, err := loadTunnel(dir, args[0])
+		if err != nil {
+			return err
+		}
+		lock, err := lockTunnel(dir, s.ID)
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+		s.PID = os.Getpid()
+		r := &tunnelRunner{
+			Dir:      dir,
+			State:    s,
+			Forwards: forwards,
+			resolve: func(s *tunnelState) (*instancePair, error) {
+				return resolveTunnelTarget(config, s)
+			},
+			connect: func(pair *instancePair) (*sshForwardingClient, error) {
+				return connect(pair, cfg)
+			},
+			stopped: make(chan struct{}),
+		}
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupt
+			r.Stop()
+		}()
+		r.Run()
+		cfg.Close()
+		fmt.Printf("%s [+] stopped\n", time.Now().Format("2006-01-02 15:04:05"))
+		return nil
+	}
+	return fmt.Errorf("unknown tunnels command %q, expected list, stop or restart", command)
+}
+
+// printTunnels prints the recorded tunnels and whether they are still running
+func printTunnels(w io.Writer, dir string, tunnels []*tunnelState) {
+	if len(tunnels) == 0 {
+		fmt.Fprintln(w, "[+] no tunnels")
+		return
+	}
+	longestName := 0
+	for _, t := range tunnels {
+		if len(t.Name) > longestName {
+			longestName = len(t.Name)
+		}
+	}
+	for _, t := range tunnels {
+		state := fmt.Sprintf("pid %d, up %s", t.PID, time.Since(t.Started).Round(time.Second))
+		status := t.Status
+		if !t.Running(dir) {
+			state = "not running"
+			status = "restart it with: salio tunnels restart " + t.ID
+			if strings.HasPrefix(t.Status, "failed") {
+				status = t.Status + ", " + status
+			}
+		}
+		fmt.Fprintf(w, "%s %-19s %s %s\n    %s\n    %s\n", t.ID, t.Target, padToLen(t.Name, " ", longestName), state, t.Forwards, status)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnelState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	web := &tunnelState{ID: "aaaa", Target: "i-web", Name: "web.prod", Started: time.Now().Add(-time.Hour)}
+	db := &tunnelState{ID: "bbbb", Target: "i-db", Name: "web.db", Started: time.Now()}
+	for _, s := range []*tunnelState{db, web} {
+		if err := s.save(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tunnels, err := loadTunnels(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 2 || tunnels[0].ID != "aaaa" || tunnels[1].ID != "bbbb" {
+		t.Errorf("Expected the tunnels oldest first, got %+v", tunnels)
+	}
+	for _, target := range []string{"bbbb", "i-db", "web.db"} {
+		found, err := findTunnels(dir, target)
+		if err != nil || len(found) != 1 || found[0].ID != "bbbb" {
+			t.Errorf("Expected %s to find tunnel bbbb, got %+v %v", target, found, err)
+		}
+	}
+	if found, _ := findTunnels(dir, "all"); len(found) != 2 {
+		t.Errorf("Expected all to find 2 tunnels, got %d", len(found))
+	}
+	if _, err := findTunnels(dir, "web.cache"); err == nil {
+		t.Errorf("Expected an error for an unknown tunnel")
+	}
+	if web.Running(dir) {
+		t.Errorf("Expected a tunnel without a process not to be running")
+	}
+	lock, err := lockTunnel(dir, web.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !web.Running(dir) {
+		t.Errorf("Expected a locked tunnel to be running")
+	}
+	if _, err := lockTunnel(dir, web.ID); err == nil {
+		t.Errorf("Expected a second runner of the tunnel to be refused")
+	}
+	lock.Close()
+	if web.Running(dir) {
+		t.Errorf("Expected the tunnel not to be running once the lock is released")
+	}
+
+	backoff := tunnelMinBackoff
+	for n := 0; n < 10; n++ {
+		backoff = nextBackoff(backoff)
+	}
+	if backoff != tunnelMaxBackoff {
+		t.Errorf("Expected the backoff to stop at %s, got %s", tunnelMaxBackoff, backoff)
+	}
+}
+
+func TestTunnelRunnerReconnects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	connected := make(chan *sshForwardingClient)
+	attempts := 0
+	r := &tunnelRunner{
+		Dir:      dir,
+		State:    &tunnelState{ID: "aaaa", Target: "i-web"},
+		Forwards: &forwardSet{},
+		resolve: func(s *tunnelState) (*instancePair, error) {
+			return &instancePair{Bastion: &instance{}, Instance: &instance{ID: s.Target}}, nil
+		},
+		connect: func(pair *instancePair) (*sshForwardingClient, error) {
+			attempts++
+			if attempts == 1 {
+				return nil, errors.New("bastion unreachable")
+			}
+			client := &sshForwardingClient{false, execServer(t), false}
+			connected <- client
+			return client, nil
+		},
+		stopped: make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		r.Run()
+		close(done)
+	}()
+
+	// drop the first connection, the runner should connect again
+	client := <-connected
+	client.Close()
+	<-connected
+	r.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the runner to stop")
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 connection attempts, got %d", attempts)
+	}
+}
+
+func TestTunnelRunnerFailsToAuthenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	attempts := 0
+	r := &tunnelRunner{
+		Dir:      dir,
+		State:    &tunnelState{ID: "aaaa", Target: "i-web"},
+		Forwards: &forwardSet{},
+		resolve: func(s *tunnelState) (*instancePair, error) {
+			return &instancePair{Bastion: &instance{}, Instance: &instance{ID: s.Target}}, nil
+		},
+		connect: func(pair *instancePair) (*sshForwardingClient, error) {
+			attempts++
+			return nil, errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey]")
+		},
+		stopped: make(chan struct{}),
+	}
+	r.Run()
+	if attempts != 1 {
+		t.Errorf("Expected no reconnection attempts, got %d attempts", attempts)
+	}
+	s, err := loadTunnel(dir, "aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(s.Status, "failed") {
+		t.Errorf("Expected the tunnel to have failed, got %q", s.Status)
+	}
+}